@@ -5,12 +5,22 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"flag"
 	"fmt" // Needed for io.EOF and ReadFull
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 )
 
 const maxMessageSize uint32 = 1024 * 4
@@ -58,8 +68,371 @@ func encodeAndSend(conn net.Conn, msg string) error {
 	return nil // Success
 }
 
+// messagePrefix starts every message printed from the server; wrapped
+// lines are indented to line up under the text after it.
+const messagePrefix = "> "
+
+// maxExpandable is how many truncated messages /expand remembers.
+const maxExpandable = 100
+
+// renderer prints server messages wrapped to the terminal width. It
+// keeps the last messages it printed for /more, and holds new ones back
+// while paused.
+type renderer struct {
+	truncate bool // Shorten words wider than a line instead of breaking them
+	keep     int  // How many messages the scroll-back and the paused backlog hold
+	out      io.Writer
+
+	mu          sync.Mutex // Guards the fields below, shared with the local commands
+	width       int        // Terminal size, kept up to date by watchSize
+	height      int
+	truncated   map[int]string // Full text of truncated messages by id
+	ids         []int          // Ids in truncated, oldest first
+	nextID      int
+	scrollback  []string // Printed messages, oldest first
+	scrollDrops int      // Messages that fell out of the scroll-back
+	paused      bool
+	held        []string // Messages received while paused, oldest first
+	heldDrops   int      // Messages dropped from held since the pause began
+}
+
+func newRenderer(truncate bool, keep int) *renderer {
+	return &renderer{truncate: truncate, keep: keep, out: os.Stdout, width: 80, height: 24, truncated: make(map[int]string), nextID: 1}
+}
+
+// watchSize reads the terminal size from stty, then again every time
+// terminalResized reports a resize. stty runs outside r.mu, so printing
+// never waits for it.
+func (r *renderer) watchSize() {
+	resized := terminalResized()
+	go func() {
+		for {
+			if width, height, ok := sttySize(); ok {
+				r.mu.Lock()
+				r.width, r.height = width, height
+				r.mu.Unlock()
+			}
+			<-resized
+		}
+	}()
+}
+
+// print writes msg to r.out, wrapped at word boundaries to the current
+// terminal width. While paused, msg is held back until resume instead.
+func (r *renderer) print(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.paused {
+		r.held = append(r.held, msg)
+		if len(r.held) > r.keep {
+			r.held = r.held[1:]
+			r.heldDrops++
+		}
+		fmt.Fprintf(r.out, "\r(paused: %d new, /resume to show) ", len(r.held)+r.heldDrops)
+		return
+	}
+	r.show(msg)
+}
+
+// show prints msg and adds it to the scroll-back. r.mu must be held.
+func (r *renderer) show(msg string) {
+	r.render(msg)
+	r.scrollback = append(r.scrollback, msg)
+	if len(r.scrollback) > r.keep {
+		r.scrollback = r.scrollback[1:]
+		r.scrollDrops++
+	}
+}
+
+// more reprints the last n messages, or a screenful if n is 0.
+func (r *renderer) more(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if n <= 0 {
+		n = r.termHeight() - 1
+	}
+	if n > len(r.scrollback) {
+		n = len(r.scrollback)
+		if r.scrollDrops > 0 {
+			fmt.Fprintf(r.out, "(%d older messages no longer kept)\n", r.scrollDrops)
+		}
+	}
+	fmt.Fprintf(r.out, "--- last %d messages ---\n", n)
+	for _, msg := range r.scrollback[len(r.scrollback)-n:] {
+		r.render(msg)
+	}
+	fmt.Fprintln(r.out, "---")
+}
+
+// pause stops printing new messages until resume. It reports false if
+// already paused.
+func (r *renderer) pause() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		return false
+	}
+	r.paused = true
+	return true
+}
+
+// resume prints the messages held back since pause and goes back to
+// printing as they arrive. It reports false if not paused.
+func (r *renderer) resume() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		return false
+	}
+	held, drops := r.held, r.heldDrops
+	r.paused, r.held, r.heldDrops = false, nil, 0
+	if len(held) == 0 {
+		return true
+	}
+
+	fmt.Fprintf(r.out, "\n--- %d messages while paused ---\n", len(held)+drops)
+	if drops > 0 {
+		fmt.Fprintf(r.out, "(%d oldest dropped, only the last %d were kept)\n", drops, len(held))
+	}
+	for _, msg := range held {
+		r.show(msg)
+	}
+	fmt.Fprintln(r.out, "---")
+	return true
+}
+
+// render prints msg wrapped to the terminal. r.mu must be held.
+func (r *renderer) render(msg string) {
+	width := r.termWidth()
+	lineWidth := width - textWidth(messagePrefix)
+	if r.truncate && lineWidth > 1 {
+		var b strings.Builder
+		shortened := false
+		for _, run := range splitRuns(msg) {
+			if !isSpaceRun(run) && textWidth(run) > lineWidth {
+				run = truncateText(run, lineWidth)
+				shortened = true
+			}
+			b.WriteString(run)
+		}
+		if shortened {
+			id := r.nextID
+			r.nextID++
+			r.truncated[id] = msg
+			r.ids = append(r.ids, id)
+			if len(r.ids) > maxExpandable {
+				delete(r.truncated, r.ids[0])
+				r.ids = r.ids[1:]
+			}
+			msg = fmt.Sprintf("%s [/expand %d]", b.String(), id)
+		}
+	}
+
+	for i, line := range wrapText(msg, lineWidth) {
+		if i == 0 {
+			fmt.Fprint(r.out, messagePrefix)
+		} else {
+			fmt.Fprint(r.out, strings.Repeat(" ", textWidth(messagePrefix)))
+		}
+		fmt.Fprintln(r.out, line)
+	}
+}
+
+// expand returns the full text of truncated message id.
+func (r *renderer) expand(id int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msg, ok := r.truncated[id]
+	return msg, ok
+}
+
+// termWidth returns the terminal width in columns: $COLUMNS if set,
+// otherwise the size last seen by watchSize, 80 until then. r.mu must
+// be held.
+func (r *renderer) termWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return r.width
+}
+
+// termHeight returns the terminal height in rows: $LINES if set,
+// otherwise the size last seen by watchSize, 24 until then. r.mu must
+// be held.
+func (r *renderer) termHeight() int {
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 0 {
+		return n
+	}
+	return r.height
+}
+
+// sttySize returns the terminal size reported by stty, and false if
+// stdin is not a terminal or stty is not available.
+func sttySize() (width, height int, ok bool) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0, false
+	}
+	f := strings.Fields(string(out))
+	if len(f) != 2 {
+		return 0, 0, false
+	}
+	height, herr := strconv.Atoi(f[0])
+	width, werr := strconv.Atoi(f[1])
+	if herr != nil || werr != nil || width < 1 || height < 1 {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// wrapText splits text into lines at most width columns wide. Newlines
+// always break; otherwise lines break at whitespace, which is dropped
+// at the break and kept everywhere else. Words wider than a line are
+// broken across lines. Widths are measured with runeWidth, so wide
+// characters count as two columns.
+func wrapText(text string, width int) []string {
+	if width < 1 {
+		return []string{text}
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		lines = append(lines, wrapLine(line, width)...)
+	}
+	return lines
+}
+
+// wrapLine wraps text, which holds no newlines, for wrapText.
+func wrapLine(text string, width int) []string {
+	var lines []string
+	var line strings.Builder
+	lineWidth := 0
+	flush := func() {
+		lines = append(lines, line.String())
+		line.Reset()
+		lineWidth = 0
+	}
+
+	space := "" // Whitespace before the next word, written only if the word follows it on the same line
+	for _, word := range splitRuns(text) {
+		if isSpaceRun(word) {
+			space = word
+			continue
+		}
+		w, sw := textWidth(word), textWidth(space)
+		switch {
+		case lineWidth > 0 && lineWidth+sw+w > width:
+			flush()
+			space = ""
+		case lineWidth == 0 && sw+w > width:
+			space = "" // Indentation that leaves no room for the word
+		}
+		line.WriteString(space)
+		lineWidth += textWidth(space)
+		space = ""
+		if w <= width-lineWidth {
+			line.WriteString(word)
+			lineWidth += w
+			continue
+		}
+		// The word is wider than a whole line: break it rune by rune.
+		for _, r := range word {
+			rw := runeWidth(r)
+			if lineWidth+rw > width && lineWidth > 0 {
+				flush()
+			}
+			line.WriteRune(r)
+			lineWidth += rw
+		}
+	}
+	if line.Len() > 0 || len(lines) == 0 {
+		flush()
+	}
+	return lines
+}
+
+// splitRuns splits s into alternating runs of whitespace and of other
+// characters, so that joining them gives back s.
+func splitRuns(s string) []string {
+	var runs []string
+	start := 0
+	for i, r := range s {
+		if i > start && unicode.IsSpace(r) != isSpaceRun(s[start:]) {
+			runs = append(runs, s[start:i])
+			start = i
+		}
+	}
+	if start < len(s) {
+		runs = append(runs, s[start:])
+	}
+	return runs
+}
+
+// isSpaceRun reports whether s starts with whitespace; for a run from
+// splitRuns, whether the whole run is whitespace.
+func isSpaceRun(s string) bool {
+	for _, r := range s {
+		return unicode.IsSpace(r)
+	}
+	return false
+}
+
+// truncateText shortens s to at most width columns, ending in an ellipsis.
+func truncateText(s string, width int) string {
+	var b strings.Builder
+	w := 0
+	for _, r := range s {
+		rw := runeWidth(r)
+		if w+rw > width-1 {
+			break
+		}
+		b.WriteRune(r)
+		w += rw
+	}
+	b.WriteRune('…')
+	return b.String()
+}
+
+// textWidth returns the number of terminal columns s occupies.
+func textWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+// runeWidth returns the number of terminal columns r occupies: 0 for
+// combining marks and zero-width characters, 2 for East Asian wide and
+// fullwidth characters and emoji, 1 otherwise.
+func runeWidth(r rune) int {
+	switch {
+	case r == 0x200B || r == 0x200D || r == 0xFE0F || unicode.Is(unicode.Mn, r):
+		return 0
+	case r >= 0x1100 && r <= 0x115F, // Hangul Jamo
+		r >= 0x2E80 && r <= 0x303E, // CJK radicals, punctuation
+		r >= 0x3041 && r <= 0x33FF, // Kana, CJK compatibility
+		r >= 0x3400 && r <= 0x4DBF, // CJK extension A
+		r >= 0x4E00 && r <= 0x9FFF, // CJK unified ideographs
+		r >= 0xA000 && r <= 0xA4CF, // Yi
+		r >= 0xAC00 && r <= 0xD7A3, // Hangul syllables
+		r >= 0xF900 && r <= 0xFAFF, // CJK compatibility ideographs
+		r >= 0xFE30 && r <= 0xFE4F, // CJK compatibility forms
+		r >= 0xFF00 && r <= 0xFF60, // Fullwidth forms
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x1F300 && r <= 0x1F64F, // Pictographs, emoticons
+		r >= 0x1F900 && r <= 0x1F9FF, // Supplemental symbols and pictographs
+		r >= 0x20000 && r <= 0x3FFFD: // CJK extensions B and later
+		return 2
+	}
+	return 1
+}
+
 // readFromServer reads messages from the server connection and prints them.
-func readFromServer(conn net.Conn) {
+func readFromServer(conn net.Conn, out *renderer, ignored *ignoreList) {
 	log.Println("Reader: Goroutine started. Waiting for messages from server...")
 
 	defer func() {
@@ -128,13 +501,273 @@ func readFromServer(conn net.Conn) {
 			continue // Skip empty messages
 		}
 
-		fmt.Print("> ")
-		fmt.Println(msgString) // Print the message
+		ignored.follow(msgString)
+		if ignored.hides(msgString) {
+			continue
+		}
+
+		out.print(msgString) // Print the message, wrapped to the terminal
+
+	}
+}
+
+// faultConn wraps a connection to simulate a bad network for manual
+// testing: added latency and jitter on every read and write, and writes
+// split into random small chunks.
+type faultConn struct {
+	net.Conn
+	latency     time.Duration
+	jitter      time.Duration
+	shortWrites bool
+}
+
+func (c *faultConn) delay() {
+	d := c.latency
+	if c.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(c.jitter)))
+	}
+	time.Sleep(d)
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.delay()
+	}
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.delay()
+	if !c.shortWrites {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := min(1+rand.Intn(3), len(p)-written)
+		n, err := c.Conn.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// simulateFaults applies the -sim-* flags to conn: it wraps conn in a
+// faultConn if latency, jitter or short writes are asked for, and closes
+// it after dropAfter if that is set.
+func simulateFaults(conn net.Conn, latency, jitter, dropAfter time.Duration, shortWrites bool) net.Conn {
+	if latency > 0 || jitter > 0 || shortWrites {
+		conn = &faultConn{Conn: conn, latency: latency, jitter: jitter, shortWrites: shortWrites}
+	}
+	if dropAfter > 0 {
+		time.AfterFunc(dropAfter, func() {
+			log.Printf("Simulating dropped connection after %s", dropAfter)
+			conn.Close()
+		})
+	}
+	return conn
+}
+
+// ignoreList holds the names set with /ignore. Chat from them is not
+// printed. It is shared between the input loop and the reader.
+type ignoreList struct {
+	mu    sync.Mutex
+	names map[string]string // Names as last seen, by ignoreKey
+}
+
+// ignoreKey folds name the way the server compares names, so an ignored
+// user cannot escape by changing the case of their name.
+func ignoreKey(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// handle runs an /ignore, /unignore or /ignorelist command.
+func (l *ignoreList) handle(fields []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if fields[0] == "/ignorelist" {
+		if len(l.names) == 0 {
+			log.Println("Not ignoring anyone")
+			return
+		}
+		names := make([]string, 0, len(l.names))
+		for _, name := range l.names {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Printf("Ignoring: %s", strings.Join(names, ", "))
+		return
+	}
+
+	if len(fields) != 2 {
+		log.Printf("Usage: %s <name>", fields[0])
+		return
+	}
+	name, key := fields[1], ignoreKey(fields[1])
+	if fields[0] == "/ignore" {
+		l.names[key] = name
+		log.Printf("Ignoring messages from %s", name)
+		return
+	}
+	if _, ok := l.names[key]; !ok {
+		log.Printf("Not ignoring %s", name)
+		return
+	}
+	delete(l.names, key)
+	log.Printf("No longer ignoring %s", name)
+}
 
+// follow moves an ignore over to the new name when msg is the server's
+// "<old> is now known as <new>" notice, so renaming does not lift it.
+func (l *ignoreList) follow(msg string) {
+	from, to, ok := strings.Cut(msg, " is now known as ")
+	if !ok || strings.ContainsRune(from, ' ') || strings.ContainsRune(to, ' ') {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.names[ignoreKey(from)]; !ok {
+		return
+	}
+	delete(l.names, ignoreKey(from))
+	l.names[ignoreKey(to)] = to
+	log.Printf("Still ignoring %s, now known as %s", from, to)
+}
+
+// hides reports whether msg is chat from an ignored name. The server
+// sends chat as "<name>: <text>"; names never contain spaces, which
+// keeps notices such as "<name> left: <text>" from matching.
+func (l *ignoreList) hides(msg string) bool {
+	name, _, ok := strings.Cut(msg, ": ")
+	if !ok || strings.ContainsRune(name, ' ') {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ignored := l.names[ignoreKey(name)]
+	return ignored
+}
+
+// snippetPlaceholder matches {name} placeholders inside a snippet.
+var snippetPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// snippets holds named message templates managed with /snip.
+type snippets map[string]string
+
+// handle runs a /snip command (args excludes "/snip"). When it expands a
+// snippet it returns the text to send and true. prompt is asked once for
+// every distinct {name} placeholder in the snippet; if it returns false
+// the expansion is abandoned.
+func (s snippets) handle(args []string, prompt func(name string) (string, bool)) (string, bool) {
+	if len(args) == 0 {
+		log.Println("Usage: /snip add <name> <text> | /snip list | /snip rm <name> | /snip <name>")
+		return "", false
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 3 {
+			log.Println("Usage: /snip add <name> <text>")
+			return "", false
+		}
+		name := args[1]
+		switch name {
+		case "add", "list", "rm":
+			log.Printf("Snippet name %q is reserved", name)
+			return "", false
+		}
+		if _, ok := s[name]; ok {
+			log.Printf("Snippet %q already exists, remove it with /snip rm %s first", name, name)
+			return "", false
+		}
+		s[name] = strings.Join(args[2:], " ")
+		log.Printf("Saved snippet %q", name)
+	case "list":
+		if len(s) == 0 {
+			log.Println("No snippets saved")
+			return "", false
+		}
+		names := make([]string, 0, len(s))
+		for name := range s {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			log.Printf("%s: %s", name, s[name])
+		}
+	case "rm":
+		if len(args) != 2 {
+			log.Println("Usage: /snip rm <name>")
+			return "", false
+		}
+		if _, ok := s[args[1]]; !ok {
+			log.Printf("No snippet named %q", args[1])
+			return "", false
+		}
+		delete(s, args[1])
+		log.Printf("Removed snippet %q", args[1])
+	default:
+		text, ok := s[args[0]]
+		if !ok {
+			log.Printf("No snippet named %q", args[0])
+			return "", false
+		}
+		values := make(map[string]string)
+		for _, m := range snippetPlaceholder.FindAllStringSubmatch(text, -1) {
+			if _, done := values[m[1]]; done {
+				continue
+			}
+			v, ok := prompt(m[1])
+			if !ok {
+				return "", false
+			}
+			values[m[1]] = v
+		}
+		return snippetPlaceholder.ReplaceAllStringFunc(text, func(p string) string {
+			return values[p[1:len(p)-1]]
+		}), true
+	}
+	return "", false
+}
+
+// sendQueue sends queued lines to the server, waiting at least pace
+// between consecutive sends. It stops at the first send error and closes
+// done when it returns.
+func sendQueue(conn net.Conn, lines <-chan string, pace *atomic.Int64, done chan<- struct{}) {
+	defer close(done)
+
+	var last time.Time
+	for text := range lines {
+		if wait := time.Duration(pace.Load()) - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		// Send the message using our protocol function
+		if err := encodeAndSend(conn, text); err != nil {
+			log.Printf("Error sending message: %v\n", err)
+			// If we can't send, the connection is likely broken, stop sending.
+			return
+		}
+		last = time.Now()
 	}
 }
 
 func main() {
+	simLatency := flag.Duration("sim-latency", 0, "DEBUG ONLY: add this delay to every read and write")
+	simJitter := flag.Duration("sim-jitter", 0, "DEBUG ONLY: add up to this much random delay on top of -sim-latency")
+	simDropAfter := flag.Duration("sim-drop-after", 0, "DEBUG ONLY: drop the connection after this long")
+	truncateWords := flag.Bool("truncate-words", false, "shorten words wider than the terminal; print them in full with /expand <id>")
+	simShortWrites := flag.Bool("sim-short-writes", false, "DEBUG ONLY: split every write into small chunks")
+	scrollback := flag.Int("scrollback", 500, "how many messages /more and /pause keep")
+	flag.Parse()
+	if *scrollback < 1 {
+		log.Fatalf("Invalid -scrollback %d: must be at least 1", *scrollback)
+	}
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	serverAddress := ":8080"
@@ -145,6 +778,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
+	conn = simulateFaults(conn, *simLatency, *simJitter, *simDropAfter, *simShortWrites)
+	if *simLatency > 0 || *simJitter > 0 || *simDropAfter > 0 || *simShortWrites {
+		log.Println("**************************************************************")
+		log.Println("* WARNING: simulated network faults are active (-sim-* flags) *")
+		log.Println("**************************************************************")
+	}
 	log.Printf("Connection established to %s. Starting message reader...", serverAddress)
 	// Ensure the connection is closed when main exits
 	defer func() {
@@ -153,12 +792,29 @@ func main() {
 	}()
 
 	// 2. Start a goroutine to read messages FROM the server
-	go readFromServer(conn)
+	out := newRenderer(*truncateWords, *scrollback)
+	out.watchSize()
+	ignored := &ignoreList{names: make(map[string]string)}
+	go readFromServer(conn, out, ignored)
+
+	// Ask the server which protocol and build it is running
+	if err := encodeAndSend(conn, "/version"); err != nil {
+		log.Printf("Error requesting server version: %v", err)
+	}
+
+	// 3. Queue outgoing lines so /pace can space them out (e.g. a pasted block)
+	var pace atomic.Int64
+	lines := make(chan string, 100)
+	sent := make(chan struct{})
+	go sendQueue(conn, lines, &pace, sent)
 
-	// 3. Read input from the user (stdin) and send it TO the server (main loop)
+	// 4. Read input from the user (stdin) and send it TO the server (main loop)
 	log.Println("Enter messages to send (Ctrl+C to exit):")
 	scanner := bufio.NewScanner(os.Stdin) // Use scanner for simpler line reading
 
+	snips := make(snippets)
+
+readLoop:
 	for scanner.Scan() { // Loop reads lines from stdin until EOF (Ctrl+D) or error
 		text := scanner.Text() // Get the line text
 		text = strings.TrimSpace(text)
@@ -167,14 +823,95 @@ func main() {
 			continue // Skip empty lines
 		}
 
-		// Send the message using our protocol function
-		err := encodeAndSend(conn, text)
-		if err != nil {
-			log.Printf("Error sending message: %v\n", err)
-			// If we can't send, the connection is likely broken, exit the loop.
-			break
+		// /pace <ms> is handled locally and never sent to the server
+		if fields := strings.Fields(text); fields[0] == "/pace" {
+			if len(fields) != 2 {
+				log.Println("Usage: /pace <ms>")
+				continue
+			}
+			ms, err := strconv.Atoi(fields[1])
+			if err != nil || ms < 0 {
+				log.Printf("Invalid pace %q: must be a non-negative number of milliseconds", fields[1])
+				continue
+			}
+			pace.Store(int64(time.Duration(ms) * time.Millisecond))
+			log.Printf("Sending at most one message every %dms", ms)
+			continue
+		}
+
+		// /expand <id> reprints a message whose long words were truncated
+		if fields := strings.Fields(text); fields[0] == "/expand" {
+			id, err := strconv.Atoi(fields[len(fields)-1])
+			if len(fields) != 2 || err != nil {
+				log.Println("Usage: /expand <id>")
+				continue
+			}
+			full, ok := out.expand(id)
+			if !ok {
+				log.Printf("No truncated message %d", id)
+				continue
+			}
+			fmt.Println(full)
+			continue
+		}
+
+		// /more [n] reprints the last n messages, a screenful by default
+		if fields := strings.Fields(text); fields[0] == "/more" {
+			n := 0
+			if len(fields) > 1 {
+				var err error
+				if n, err = strconv.Atoi(fields[1]); err != nil || n < 1 || len(fields) > 2 {
+					log.Println("Usage: /more [n]")
+					continue
+				}
+			}
+			out.more(n)
+			continue
+		}
+
+		// /pause holds back incoming messages until /resume prints them
+		if text == "/pause" {
+			if !out.pause() {
+				log.Println("Already paused, /resume to show new messages")
+				continue
+			}
+			log.Println("Paused, new messages are held until /resume")
+			continue
+		}
+		if text == "/resume" {
+			if !out.resume() {
+				log.Println("Not paused")
+			}
+			continue
+		}
+
+		// /ignore, /unignore and /ignorelist filter what is printed locally
+		if fields := strings.Fields(text); fields[0] == "/ignore" || fields[0] == "/unignore" || fields[0] == "/ignorelist" {
+			ignored.handle(fields)
+			continue
+		}
+
+		// /snip manages and expands snippets locally; only the expansion is sent
+		if fields := strings.Fields(text); fields[0] == "/snip" {
+			expanded, ok := snips.handle(fields[1:], func(name string) (string, bool) {
+				fmt.Printf("%s: ", name)
+				if !scanner.Scan() {
+					return "", false
+				}
+				return strings.TrimSpace(scanner.Text()), true
+			})
+			if !ok {
+				continue
+			}
+			text = expanded
 		}
 
+		select {
+		case lines <- text:
+		case <-sent:
+			// The sender stopped after an error, the connection is likely broken.
+			break readLoop
+		}
 	}
 
 	// Check if the scanner stopped due to an error
@@ -182,6 +919,15 @@ func main() {
 		log.Printf("Error reading from stdin: %v", err)
 	}
 
+	// Let the sender drain whatever is still queued
+	close(lines)
+	<-sent
+
+	// Say goodbye so the server can tell the room we left on purpose
+	if err := encodeAndSend(conn, "/quit"); err != nil {
+		log.Printf("Error sending goodbye: %v", err)
+	}
+
 	log.Println("Client exiting.")
 	// The defer conn.Close() will run now.
 }
@@ -0,0 +1,31 @@
+//go:build !windows
+
+// The client is built from client.go and the resize file for the target:
+//
+//	go build client.go client_resize.go          (Unix)
+//	go build client.go client_resize_windows.go  (Windows)
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// terminalResized returns a channel that receives a value after every
+// resize of the terminal, as reported by SIGWINCH.
+func terminalResized() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	resized := make(chan struct{}, 1)
+	go func() {
+		for range signals {
+			select {
+			case resized <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return resized
+}
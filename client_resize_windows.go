@@ -0,0 +1,20 @@
+//go:build windows
+
+package main
+
+import "time"
+
+// terminalResized returns a channel that receives a value once a second.
+// Windows has no SIGWINCH, so the terminal size is polled instead.
+func terminalResized() <-chan struct{} {
+	resized := make(chan struct{}, 1)
+	go func() {
+		for range time.Tick(time.Second) {
+			select {
+			case resized <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return resized
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Local commands report through the log; keep test output readable.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestIgnoreListFollowsRenames(t *testing.T) {
+	l := &ignoreList{names: make(map[string]string)}
+	l.handle([]string{"/ignore", "Troll"})
+
+	steps := []struct {
+		msg  string
+		hide bool
+	}{
+		{"troll: hi", true},
+		{"TROLL: hi", true},
+		{"friend: hi", false},
+		{"troll is now known as Angel", false},
+		{"angel: it's not me", true},
+		{"troll: that was someone else", false},
+		{"angel left: bye", false},
+		{"Angel is now known as friend2", false},
+		{"friend2: hello", true},
+	}
+	for _, step := range steps {
+		l.follow(step.msg)
+		if got := l.hides(step.msg); got != step.hide {
+			t.Errorf("hides(%q) = %v, want %v", step.msg, got, step.hide)
+		}
+	}
+
+	l.handle([]string{"/unignore", "FRIEND2"})
+	if l.hides("friend2: hello") {
+		t.Error("still hidden after /unignore")
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"", 10, []string{""}},
+		{"hello", 0, []string{"hello"}},
+		{"a  b   c", 20, []string{"a  b   c"}},
+		{"abc def ghi", 7, []string{"abc def", "ghi"}},
+		{"abc def ghi", 3, []string{"abc", "def", "ghi"}},
+		{"abc    def", 6, []string{"abc", "def"}},
+		{"  indented  text here", 10, []string{"  indented", "text here"}},
+		{"     deep", 6, []string{"deep"}},
+		{"one\n\n  two  words", 20, []string{"one", "", "  two  words"}},
+		{"abcdefghijkl xy", 5, []string{"abcde", "fghij", "kl xy"}},
+		{"a\tb", 10, []string{"a\tb"}},
+		{"日本語 テスト", 5, []string{"日本", "語", "テス", "ト"}},
+		{"café au lait", 7, []string{"café au", "lait"}},
+	}
+	for _, tt := range tests {
+		got := wrapText(tt.text, tt.width)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("wrapText(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	indent := strings.Repeat(" ", textWidth(messagePrefix))
+	tests := []struct {
+		columns  string
+		truncate bool
+		msg      string
+		want     string
+	}{
+		{"80", false, "alice:  spaced  out", messagePrefix + "alice:  spaced  out\n"},
+		{fmt.Sprint(textWidth(messagePrefix) + 10), false, "alice: hello there world",
+			messagePrefix + "alice:\n" + indent + "hello\n" + indent + "there\n" + indent + "world\n"},
+		{fmt.Sprint(textWidth(messagePrefix) + 12), false, "bob: line one\nline two",
+			messagePrefix + "bob: line\n" + indent + "one\n" + indent + "line two\n"},
+		{fmt.Sprint(textWidth(messagePrefix) + 6), true, "x:  abcdefghij  y",
+			messagePrefix + "x:\n" + indent + "abcde…\n" + indent + "y\n" + indent + "[/expa\n" + indent + "nd 1]\n"},
+	}
+	for _, tt := range tests {
+		t.Setenv("COLUMNS", tt.columns)
+		var buf bytes.Buffer
+		r := newRenderer(tt.truncate, 10)
+		r.out = &buf
+		r.print(tt.msg)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("COLUMNS=%s truncate=%v print(%q):\ngot:\n%s\nwant:\n%s", tt.columns, tt.truncate, tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestRendererPauseAndMore(t *testing.T) {
+	t.Setenv("COLUMNS", "80")
+	t.Setenv("LINES", "3")
+	var buf bytes.Buffer
+	r := newRenderer(false, 3)
+	r.out = &buf
+	step := func(name string, do func(), want string) {
+		t.Helper()
+		buf.Reset()
+		do()
+		if got := buf.String(); got != want {
+			t.Errorf("%s:\ngot:\n%q\nwant:\n%q", name, got, want)
+		}
+	}
+	line := func(msg string) string { return messagePrefix + msg + "\n" }
+
+	step("print", func() { r.print("one"); r.print("two") }, line("one")+line("two"))
+	step("resume while not paused", func() {
+		if r.resume() {
+			t.Error("resume reported true while not paused")
+		}
+	}, "")
+	step("pause", func() {
+		if !r.pause() || r.pause() {
+			t.Error("pause should report true once, then false")
+		}
+	}, "")
+	step("print while paused", func() {
+		for _, msg := range []string{"three", "four", "five", "six"} {
+			r.print(msg)
+		}
+	}, "\r(paused: 1 new, /resume to show) \r(paused: 2 new, /resume to show) "+
+		"\r(paused: 3 new, /resume to show) \r(paused: 4 new, /resume to show) ")
+	step("more while paused shows the scroll-back", func() { r.more(0) },
+		"--- last 2 messages ---\n"+line("one")+line("two")+"---\n")
+	step("resume", func() {
+		if !r.resume() {
+			t.Error("resume reported false while paused")
+		}
+	}, "\n--- 4 messages while paused ---\n(1 oldest dropped, only the last 3 were kept)\n"+
+		line("four")+line("five")+line("six")+"---\n")
+	step("more with drops", func() { r.more(10) },
+		"(2 older messages no longer kept)\n--- last 3 messages ---\n"+line("four")+line("five")+line("six")+"---\n")
+	step("more n", func() { r.more(1) }, "--- last 1 messages ---\n"+line("six")+"---\n")
+	step("pause and resume with nothing held", func() {
+		r.pause()
+		if !r.resume() {
+			t.Error("resume reported false while paused")
+		}
+	}, "")
+}
+
+// recordConn is a net.Conn that records each write and when it was
+// made. Writes fail with err once it is set.
+type recordConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	writes [][]byte
+	at     []time.Time
+	err    error
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.writes = append(c.writes, bytes.Clone(p))
+	c.at = append(c.at, time.Now())
+	return len(p), nil
+}
+
+// frames decodes the length-prefixed messages written so far.
+func (c *recordConn) frames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := bytes.Join(c.writes, nil)
+	var frames []string
+	for len(b) >= 4 {
+		n := binary.BigEndian.Uint32(b)
+		frames = append(frames, string(b[4:4+n]))
+		b = b[4+n:]
+	}
+	return frames
+}
+
+func TestSendQueuePacing(t *testing.T) {
+	const pace = 40 * time.Millisecond
+	conn := &recordConn{}
+	lines := make(chan string, 10)
+	var p atomic.Int64
+	p.Store(int64(pace))
+	done := make(chan struct{})
+	go sendQueue(conn, lines, &p, done)
+
+	want := []string{"one", "two", "three", "four"}
+	for _, line := range want {
+		lines <- line
+	}
+	close(lines)
+	<-done
+
+	if got := conn.frames(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q in order", got, want)
+	}
+	for i := 1; i < len(conn.at); i++ {
+		if gap := conn.at[i].Sub(conn.at[i-1]); gap < pace {
+			t.Errorf("send %d came %s after the previous one, want at least %s", i, gap, pace)
+		}
+	}
+
+	// Without a pace, queued lines go out back to back.
+	conn = &recordConn{}
+	lines = make(chan string, 10)
+	p.Store(0)
+	done = make(chan struct{})
+	go sendQueue(conn, lines, &p, done)
+	start := time.Now()
+	for _, line := range want {
+		lines <- line
+	}
+	close(lines)
+	<-done
+	if elapsed := time.Since(start); elapsed >= pace {
+		t.Errorf("unpaced sends took %s", elapsed)
+	}
+
+	// A failed send stops the queue even though lines is still open.
+	conn = &recordConn{err: errors.New("broken pipe")}
+	lines = make(chan string, 10)
+	done = make(chan struct{})
+	go sendQueue(conn, lines, &p, done)
+	lines <- "lost"
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendQueue kept running after a send failed")
+	}
+}
+
+func TestSimulateFaults(t *testing.T) {
+	plain := &recordConn{}
+	if conn := simulateFaults(plain, 0, 0, 0, false); conn != plain {
+		t.Errorf("no faults set, but the connection was wrapped in %T", conn)
+	}
+
+	// Short writes arrive intact, split into chunks of 1-3 bytes.
+	rec := &recordConn{}
+	conn := simulateFaults(rec, 0, 0, 0, true)
+	msg := []byte(strings.Repeat("0123456789", 10))
+	if n, err := conn.Write(msg); n != len(msg) || err != nil {
+		t.Fatalf("Write = %d, %v, want %d, nil", n, err, len(msg))
+	}
+	for _, w := range rec.writes {
+		if len(w) < 1 || len(w) > 3 {
+			t.Errorf("chunk of %d bytes, want 1-3", len(w))
+		}
+	}
+	if got := bytes.Join(rec.writes, nil); !bytes.Equal(got, msg) {
+		t.Errorf("chunks join to %q, want %q", got, msg)
+	}
+
+	// Latency and jitter delay both reads and writes.
+	const latency, jitter = 30 * time.Millisecond, 20 * time.Millisecond
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn = simulateFaults(local, latency, jitter, 0, false)
+	go io.Copy(remote, remote) // Echo back whatever is written
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		conn.Write([]byte("x"))
+		if d := time.Since(start); d < latency {
+			t.Errorf("write took %s, want at least %s", d, latency)
+		}
+		start = time.Now()
+		conn.Read(make([]byte, 1))
+		if d := time.Since(start); d < latency {
+			t.Errorf("read took %s, want at least %s", d, latency)
+		}
+	}
+
+	// The connection is closed once dropAfter passes.
+	local, remote = net.Pipe()
+	simulateFaults(local, 0, 0, 50*time.Millisecond, false)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the peer after the drop = %v, want EOF", err)
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	s := make(snippets)
+	var asked []string
+	answers := map[string]string{"who": "Bob", "when": "noon"}
+	prompt := func(name string) (string, bool) {
+		asked = append(asked, name)
+		v, ok := answers[name]
+		return v, ok
+	}
+	run := func(args ...string) (string, bool) {
+		asked = nil
+		return s.handle(args, prompt)
+	}
+
+	if _, ok := run("add", "greet", "hi", "{who},", "lunch", "at", "{when}?", "{who}", "{not", "a}", "placeholder"); ok {
+		t.Error("add returned text to send")
+	}
+	text, ok := run("greet")
+	if want := "hi Bob, lunch at noon? Bob {not a} placeholder"; !ok || text != want {
+		t.Errorf("expanded to %q, %v, want %q", text, ok, want)
+	}
+	if strings.Join(asked, ",") != "who,when" {
+		t.Errorf("prompted for %q, want each placeholder once in order", asked)
+	}
+
+	// Cancelling a prompt abandons the expansion.
+	run("add", "ask", "{who}", "about", "{topic}")
+	if text, ok := run("ask"); ok {
+		t.Errorf("expansion sent %q after a prompt was cancelled", text)
+	}
+	if strings.Join(asked, ",") != "who,topic" {
+		t.Errorf("prompted for %q, want who then topic", asked)
+	}
+
+	// Existing and reserved names are not overwritten.
+	for _, name := range []string{"greet", "add", "list", "rm"} {
+		run("add", name, "replacement")
+	}
+	if s["greet"] == "replacement" || len(s) != 2 {
+		t.Errorf("snippets after name collisions: %q", s)
+	}
+
+	run("rm", "greet")
+	if _, ok := run("greet"); ok {
+		t.Error("removed snippet still expands")
+	}
+	run("add", "greet", "hello again")
+	if text, ok := run("greet"); !ok || text != "hello again" {
+		t.Errorf("re-added snippet expands to %q, %v", text, ok)
+	}
+}
@@ -0,0 +1,199 @@
+// frametrace pretty-prints the pcapng trace written by the server's
+// -frame-trace flag, reassembling the length-prefixed frames sent in
+// each direction of every traced connection.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	sectionHeader        uint32 = 0x0A0D0D0A
+	interfaceDescription uint32 = 0x00000001
+	enhancedPacket       uint32 = 0x00000006
+	byteOrderMagic       uint32 = 0x1A2B3C4D
+	optIfName            uint16 = 2
+	optEPBFlags          uint16 = 2
+)
+
+// stream holds the not yet decoded bytes of one direction of a connection.
+type stream struct {
+	buf bytes.Buffer
+}
+
+type tracer struct {
+	order   binary.ByteOrder
+	ifNames []string
+	streams map[[2]uint32]*stream
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: frametrace <trace.pcapng>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("unable to open trace: %v", err)
+	}
+	defer f.Close()
+
+	t := &tracer{order: binary.BigEndian, streams: make(map[[2]uint32]*stream)}
+	if err := t.run(f); err != nil {
+		log.Fatalf("reading trace: %v", err)
+	}
+}
+
+func (t *tracer) run(r io.Reader) error {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(r, head); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// The section header's byte-order magic decides how every length
+		// in the section, including its own, is encoded.
+		blockType := binary.BigEndian.Uint32(head)
+		if blockType == sectionHeader {
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint32(magic) == byteOrderMagic {
+				t.order = binary.LittleEndian
+			} else {
+				t.order = binary.BigEndian
+			}
+			head = append(head, magic...)
+		} else {
+			blockType = t.order.Uint32(head)
+		}
+
+		total := t.order.Uint32(head[4:])
+		if total < 12 || total%4 != 0 {
+			return fmt.Errorf("invalid block length %d", total)
+		}
+		rest := make([]byte, int(total)-len(head))
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return err
+		}
+		body := append(head[8:], rest[:len(rest)-4]...)
+
+		switch blockType {
+		case sectionHeader:
+			t.ifNames = nil
+		case interfaceDescription:
+			t.interfaceBlock(body)
+		case enhancedPacket:
+			if err := t.packetBlock(body); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *tracer) interfaceBlock(body []byte) {
+	name := fmt.Sprintf("if%d", len(t.ifNames))
+	if len(body) >= 8 {
+		for code, value := range t.options(body[8:]) {
+			if code == optIfName {
+				name = string(value)
+			}
+		}
+	}
+	t.ifNames = append(t.ifNames, name)
+}
+
+func (t *tracer) packetBlock(body []byte) error {
+	if len(body) < 20 {
+		return fmt.Errorf("short packet block")
+	}
+	iface := t.order.Uint32(body)
+	ts := uint64(t.order.Uint32(body[4:]))<<32 | uint64(t.order.Uint32(body[8:]))
+	capLen := int(t.order.Uint32(body[12:]))
+	if 20+capLen > len(body) {
+		return fmt.Errorf("packet length %d exceeds block", capLen)
+	}
+	data := body[20 : 20+capLen]
+
+	var direction uint32
+	optStart := 20 + capLen + (4-capLen%4)%4
+	if optStart <= len(body) {
+		if flags, ok := t.options(body[optStart:])[optEPBFlags]; ok && len(flags) == 4 {
+			direction = t.order.Uint32(flags) & 0x3
+		}
+	}
+
+	name := fmt.Sprintf("if%d", iface)
+	if int(iface) < len(t.ifNames) {
+		name = t.ifNames[iface]
+	}
+	arrow := "?"
+	switch direction {
+	case 1:
+		arrow = "->" // Client to server
+	case 2:
+		arrow = "<-" // Server to client
+	}
+
+	s, ok := t.streams[[2]uint32{iface, direction}]
+	if !ok {
+		s = &stream{}
+		t.streams[[2]uint32{iface, direction}] = s
+	}
+	s.buf.Write(data)
+
+	when := time.UnixMicro(int64(ts)).Format("15:04:05.000000")
+	for s.buf.Len() >= 4 {
+		msgLen := binary.BigEndian.Uint32(s.buf.Bytes())
+		if s.buf.Len() < 4+int(msgLen) {
+			break
+		}
+		frame := s.buf.Next(4 + int(msgLen))
+		fmt.Printf("%s %s %s len=%d %s\n", when, name, arrow, msgLen, formatBody(frame[4:]))
+	}
+	return nil
+}
+
+// options parses a pcapng option list into a code to value map.
+func (t *tracer) options(b []byte) map[uint16][]byte {
+	opts := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		code := t.order.Uint16(b)
+		n := int(t.order.Uint16(b[2:]))
+		end := 4 + n + (4-n%4)%4 // Values are padded to 32 bits
+		if code == 0 || end > len(b) {
+			break
+		}
+		opts[code] = b[4 : 4+n]
+		b = b[end:]
+	}
+	return opts
+}
+
+// formatBody renders printable UTF-8 bodies as quoted text and anything
+// else as hex.
+func formatBody(body []byte) string {
+	if utf8.Valid(body) && !bytes.ContainsFunc(body, func(r rune) bool { return r < 0x20 && r != '\t' }) {
+		return fmt.Sprintf("%q", body)
+	}
+	return "hex:" + hex.EncodeToString(body)
+}
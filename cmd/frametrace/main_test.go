@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	tr := &tracer{order: binary.BigEndian}
+	list := []byte{
+		0, 2, 0, 3, 'a', 'b', 'c', 0, // if_name "abc", padded
+		0, 9, 0, 4, 1, 2, 3, 4,
+		0, 0, 0, 0, // End of options
+	}
+	opts := tr.options(list)
+	if !bytes.Equal(opts[2], []byte("abc")) || !bytes.Equal(opts[9], []byte{1, 2, 3, 4}) || len(opts) != 2 {
+		t.Errorf("options = %v", opts)
+	}
+
+	// Truncated lists, including one cut inside the padding, must not panic.
+	for n := range list {
+		tr.options(list[:n])
+	}
+	if opts := tr.options(list[:7]); len(opts) != 0 {
+		t.Errorf("option missing its padding was parsed: %v", opts)
+	}
+}
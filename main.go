@@ -2,85 +2,318 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const maxMessageSize uint32 = 1024 * 4
 
+// maxNickLen caps the length, in runes, of a nickname.
+const maxNickLen = 20
+
+// maxLeaveMsgLen caps the length, in runes, of a custom leave message.
+const maxLeaveMsgLen = 100
+
+// whoPageBytes caps the names listed in one /who reply, leaving room
+// within maxMessageSize for the rest of the reply text.
+const whoPageBytes = int(maxMessageSize) - 256
+
+// protocolVersion is the version of the length-prefixed wire protocol.
+const protocolVersion = 1
+
+// Build information, set at link time with
+// -ldflags "-X main.version=v1.2.3 -X main.buildTime=2024-01-15T10:30:00Z".
+var (
+	version   = "dev"
+	buildTime = "unknown"
+)
+
+// rename records one nickname change.
+type rename struct {
+	from, to string
+	at       time.Time
+}
+
 type client struct {
-	conn          net.Conn
-	name          string
-	serverMessage chan<- message
-	disconnect    chan<- net.Addr // Add disconnection channel
+	conn           net.Conn
+	mu             sync.Mutex // Guards name, which the run loop changes on /nick
+	name           string
+	renames        []rename // Every nickname change of this connection, oldest first
+	serverMessage  chan<- message
+	disconnect     chan<- net.Addr // Add disconnection channel
+	halfCloseGrace time.Duration   // Longest wait for replies to be written after the peer stops sending
+	leaveMsg       string          // Custom leave message set with /leavemsg
+	saidGoodbye    bool            // Left with /quit rather than dropping the connection
+	closed         atomic.Bool     // Set when the connection is being torn down; broadcasts skip it
+	kicked         bool            // Removed with the admin kick command
+	blankNotice    string          // Sent back when a whitespace-only message is dropped, if set
+	maxInvalidUTF8 int             // Disconnect after this many invalid UTF-8 messages in a row, 0 never
+	wrongProtocol  *atomic.Int64   // Server-wide count of connections speaking another protocol
+	location       *time.Location  // Time zone for timestamps sent to this client, set with /tz
+	quietJoins     bool            // Don't deliver join/leave notices, toggled with /quietjoins
+	messageLimit   *atomic.Uint32  // Current server-wide message size limit, at most maxMessageSize
+	connectedAt    time.Time
+	lastActivity   time.Time // When the client last sent chat; commands don't count
+	away           bool      // Marked away after idling, cleared by the next chat message
+	archiveTo      *client   // Member that gets a copy of every chat message, set with /archive
+
+	// Used by flushWrites when the client stops sending.
+	flush        chan<- chan struct{} // Run loop barrier, see server.flush
+	writeFailed  chan struct{}        // Closed by the first failed write to the connection
+	writeFailure sync.Once
+
+	// Connection statistics for /conninfo, updated from both the reader
+	// goroutine and the run loop.
+	framesIn, bytesIn   atomic.Uint64
+	framesOut, bytesOut atomic.Uint64
+	dropped             atomic.Uint64 // Messages to this client that could not be sent
+}
+
+// getName returns the client's current name. Code outside the run loop
+// must use it instead of reading name directly.
+func (c *client) getName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// setName changes the client's name. Only the run loop calls it.
+func (c *client) setName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.name = name
+}
+
+// wrongProtocolBody explains to people pointing browsers, curl or TLS
+// clients at the chat port what they have reached.
+const wrongProtocolBody = "This is a go-network-tcp chat server, not a web server. Use the chat client to connect (TLS required: no).\n"
+
+// sniffProtocol reports which foreign protocol the first four bytes of a
+// connection look like: "http", "tls", or "" for anything else. Read as a
+// length prefix, all of these exceed maxMessageSize, so a valid chat
+// frame can never match.
+func sniffProtocol(b []byte) string {
+	switch string(b) {
+	case "GET ", "POST", "PUT ", "HEAD", "HTTP":
+		return "http"
+	}
+	// TLS handshake record: content type 22, protocol version 3.x
+	if b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04 {
+		return "tls"
+	}
+	return ""
+}
+
+// rejectWrongProtocol answers a connection that spoke proto instead of
+// the chat protocol with a readable explanation.
+func (c *client) rejectWrongProtocol(proto string) {
+	total := c.wrongProtocol.Add(1)
+	log.Printf("Client %s sent %s instead of a chat frame. Rejecting (%d wrong-protocol connections so far).\n", c.conn.RemoteAddr().String(), proto, total)
+
+	reply := wrongProtocolBody
+	if proto == "http" {
+		reply = fmt.Sprintf("HTTP/1.0 400 Bad Request\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(wrongProtocolBody), wrongProtocolBody)
+	}
+	if _, err := c.conn.Write([]byte(reply)); err != nil {
+		log.Printf("Error writing wrong-protocol reply to %s: %v", c.conn.RemoteAddr().String(), err)
+	}
 }
 
-func (c *client) readInput() {
+// sniffTimeout is how long a new connection's first bytes are awaited to
+// tell other protocols apart. Clients that stay silent longer join anyway.
+const sniffTimeout = 2 * time.Second
+
+// sniffFirstBytes reads up to the first 4 bytes of a new connection, before
+// it joins the room, so browsers, curl and TLS clients are told what they
+// have reached instead of being announced as members. A client that sends
+// nothing within sniffTimeout is let in, as it may only want to listen. It
+// returns the bytes read, for readInput, and false if the connection was
+// rejected or closed.
+func (c *client) sniffFirstBytes() ([]byte, bool) {
+	c.conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 4)
+	n, err := io.ReadFull(c.conn, buf)
+	switch {
+	case err == nil:
+		if proto := sniffProtocol(buf); proto != "" {
+			c.rejectWrongProtocol(proto)
+			return nil, false
+		}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+	default:
+		log.Printf("Connection %s closed before joining: %v\n", c.conn.RemoteAddr().String(), err)
+		return nil, false
+	}
+	return buf[:n], true
+}
+
+// flushWrites is called when the client stops sending. The peer may
+// have half-closed and still be reading, so it waits until the run loop
+// has written the replies to everything the client sent. It waits at most
+// halfCloseGrace and returns as soon as a write fails, which means the
+// peer closed completely. With nothing left to reply to it returns
+// straight away.
+func (c *client) flushWrites() {
+	addr := c.conn.RemoteAddr().String()
+	log.Printf("Client %s (%s) stopped sending, flushing replies for up to %s before closing\n", c.getName(), addr, c.halfCloseGrace)
+	timer := time.NewTimer(c.halfCloseGrace)
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	select {
+	case c.flush <- done:
+		select {
+		case <-done:
+		case <-c.writeFailed:
+		case <-timer.C:
+		}
+	case <-c.writeFailed:
+	case <-timer.C:
+	}
+
+	select {
+	case <-c.writeFailed:
+		log.Printf("Client %s (%s) closed completely, a reply could not be written\n", c.getName(), addr)
+	case <-done:
+		log.Printf("Client %s (%s) half-closed, all replies written\n", c.getName(), addr)
+	default:
+		log.Printf("Client %s (%s) replies not written within %s, closing\n", c.getName(), addr, c.halfCloseGrace)
+	}
+}
+
+// readInput reads frames from the client until it disconnects, starting
+// with prefix, the bytes sniffFirstBytes already took off the connection.
+func (c *client) readInput(prefix []byte) {
 	defer func() {
 		log.Printf("Closing connection %s\n", c.conn.RemoteAddr().String())
+		// Stop broadcasts writing to the connection while the run loop
+		// catches up with the disconnect below.
+		c.closed.Store(true)
 		// Notify server this client is disconnecting
 		c.disconnect <- c.conn.RemoteAddr()
 		c.conn.Close()
 	}()
 
+	in := io.MultiReader(bytes.NewReader(prefix), c.conn)
+	invalidUTF8 := 0 // Consecutive messages that were not valid UTF-8
 	for {
 		// 1. Read the 4-byte length prefix
 		lenBuf := make([]byte, 4)
-		_, err := io.ReadFull(c.conn, lenBuf)
+		_, err := io.ReadFull(in, lenBuf)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("Client %s (%s) closed while reading length of buffer\n", c.name, c.conn.RemoteAddr().String())
+				// Without a grace period a half-close is treated as a close.
+				if c.halfCloseGrace > 0 {
+					c.flushWrites()
+				} else {
+					log.Printf("Client %s (%s) closed while reading length of buffer\n", c.getName(), c.conn.RemoteAddr().String())
+				}
 			} else {
-				log.Printf("Error reading length from %s (%s): %v\n", c.name, c.conn.RemoteAddr().String(), err)
+				log.Printf("Error reading length from %s (%s): %v\n", c.getName(), c.conn.RemoteAddr().String(), err)
 			}
 			return
 		}
 
 		// Log the raw bytes for debugging
-		log.Printf("Server received length bytes: %v from %s", lenBuf, c.name)
+		log.Printf("Server received length bytes: %v from %s", lenBuf, c.getName())
 
 		// 2. Decode the length prefix
 		var msgLen uint32
 		err = binary.Read(bytes.NewReader(lenBuf), binary.BigEndian, &msgLen)
 		if err != nil {
-			log.Printf("Error decoding message length from %s: %s\n", c.name, err)
+			log.Printf("Error decoding message length from %s: %s\n", c.getName(), err)
 			return
 		}
 
-		log.Printf("Server decoded message length: %d from %s", msgLen, c.name)
+		log.Printf("Server decoded message length: %d from %s", msgLen, c.getName())
 
 		// 3. Validate the message length
 		if msgLen == 0 {
-			log.Printf("Client %s (%s) sent message with zero length. Ignoring.\n", c.name, c.conn.RemoteAddr().String())
+			log.Printf("Client %s (%s) sent message with zero length. Ignoring.\n", c.getName(), c.conn.RemoteAddr().String())
 			continue
 		}
 		if msgLen > maxMessageSize {
-			log.Printf("Client %s (%s) message length %d exceeds limit %d. Disconnecting.\n", c.name, c.conn.RemoteAddr().String(), msgLen, maxMessageSize)
+			log.Printf("Client %s (%s) message length %d exceeds limit %d. Disconnecting.\n", c.getName(), c.conn.RemoteAddr().String(), msgLen, maxMessageSize)
 			return
 		}
+		// Below the protocol maximum, the limit shrinks as the server fills
+		// up; oversized messages are skipped rather than disconnecting.
+		if limit := c.messageLimit.Load(); msgLen > limit {
+			log.Printf("Client %s (%s) message length %d exceeds current limit %d. Dropping.\n", c.getName(), c.conn.RemoteAddr().String(), msgLen, limit)
+			if _, err := io.CopyN(io.Discard, in, int64(msgLen)); err != nil {
+				log.Printf("Error skipping message body from %s (%s): %v\n", c.getName(), c.conn.RemoteAddr().String(), err)
+				return
+			}
+			c.msg(fmt.Sprintf("MESSAGE_TOO_LARGE: current_limit=%d", limit))
+			continue
+		}
 
 		// 4. Read the message body
 		msgBuf := make([]byte, msgLen)
-		_, connErr := io.ReadFull(c.conn, msgBuf)
+		_, connErr := io.ReadFull(in, msgBuf)
 		if connErr != nil {
 			if connErr == io.EOF {
-				log.Printf("Client %s (%s) closed while reading message body\n", c.name, c.conn.RemoteAddr().String())
+				log.Printf("Client %s (%s) closed while reading message body\n", c.getName(), c.conn.RemoteAddr().String())
 			} else {
-				log.Printf("Error reading message body from %s (%s): %v\n", c.name, c.conn.RemoteAddr().String(), connErr)
+				log.Printf("Error reading message body from %s (%s): %v\n", c.getName(), c.conn.RemoteAddr().String(), connErr)
 			}
 			return
 		}
+		c.framesIn.Add(1)
+		c.bytesIn.Add(4 + uint64(msgLen))
+
+		// 5. Process the message. Invalid UTF-8 is never broadcast: the
+		// sender gets INVALID_UTF8, and is disconnected after
+		// maxInvalidUTF8 such messages in a row.
+		if !utf8.Valid(msgBuf) {
+			invalidUTF8++
+			if c.maxInvalidUTF8 > 0 && invalidUTF8 >= c.maxInvalidUTF8 {
+				log.Printf("Client %s (%s) sent %d invalid UTF-8 messages in a row. Disconnecting.\n", c.getName(), c.conn.RemoteAddr().String(), invalidUTF8)
+				return
+			}
+			log.Printf("Client %s (%s) sent invalid UTF-8. Dropping.\n", c.getName(), c.conn.RemoteAddr().String())
+			c.msg("INVALID_UTF8")
+			continue
+		}
+		invalidUTF8 = 0
 
-		// 5. Process the message
 		msgString := string(msgBuf)
 		msgString = strings.TrimSpace(msgString)
 
-		log.Printf("Server received message: '%s' from %s", msgString, c.name)
+		// Whitespace-only messages would broadcast as an empty line
+		if msgString == "" {
+			log.Printf("Client %s (%s) sent whitespace-only message. Dropping.\n", c.getName(), c.conn.RemoteAddr().String())
+			if c.blankNotice != "" {
+				c.msg(c.blankNotice)
+			}
+			continue
+		}
+
+		log.Printf("Server received message: '%s' from %s", msgString, c.getName())
 
 		// Send to server channel for broadcasting
 		c.serverMessage <- message{
@@ -96,34 +329,38 @@ func (c *client) msg(msg string) {
 	msgLen := uint32(len(msgBytes))
 
 	if msgLen == 0 {
-		log.Printf("Skipping send of zero-length message to %s", c.name)
+		log.Printf("Skipping send of zero-length message to %s", c.getName())
 		return
 	}
 	if msgLen > maxMessageSize {
-		log.Printf("ERROR: Trying to send message of size %d to %s, which exceeds max %d", msgLen, c.name, maxMessageSize)
+		log.Printf("ERROR: Trying to send message of size %d to %s, which exceeds max %d", msgLen, c.getName(), maxMessageSize)
+		c.dropped.Add(1)
 		return
 	}
 
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.BigEndian, &msgLen)
 	if err != nil {
-		log.Printf("Error encoding message length for client %s (%s): %v", c.name, c.conn.RemoteAddr().String(), err)
+		log.Printf("Error encoding message length for client %s (%s): %v", c.getName(), c.conn.RemoteAddr().String(), err)
 		return
 	}
 
 	_, err = buf.Write(msgBytes)
 	if err != nil {
-		log.Printf("Error writing message bytes to buffer for client %s (%s): %v", c.name, c.conn.RemoteAddr().String(), err)
+		log.Printf("Error writing message bytes to buffer for client %s (%s): %v", c.getName(), c.conn.RemoteAddr().String(), err)
 		return
 	}
 
 	n, err := c.conn.Write(buf.Bytes())
+	c.bytesOut.Add(uint64(n))
 	if err != nil {
-		log.Printf("Error writing message to client %s (%s): %v", c.name, c.conn.RemoteAddr().String(), err)
-
+		log.Printf("Error writing message to client %s (%s): %v", c.getName(), c.conn.RemoteAddr().String(), err)
+		c.dropped.Add(1)
+		c.writeFailure.Do(func() { close(c.writeFailed) })
 	} else {
+		c.framesOut.Add(1)
 		if n != buf.Len() {
-			log.Printf("WARN: Short write sending to %s (%s). Wrote %d bytes, expected %d", c.name, c.conn.RemoteAddr().String(), n, buf.Len())
+			log.Printf("WARN: Short write sending to %s (%s). Wrote %d bytes, expected %d", c.getName(), c.conn.RemoteAddr().String(), n, buf.Len())
 		}
 	}
 
@@ -134,48 +371,1055 @@ type message struct {
 	msg    string
 }
 
+// pcapng block types and constants used by frameTrace.
+const (
+	pcapngSectionHeader        uint32 = 0x0A0D0D0A
+	pcapngInterfaceDescription uint32 = 0x00000001
+	pcapngEnhancedPacket       uint32 = 0x00000006
+	pcapngByteOrderMagic       uint32 = 0x1A2B3C4D
+	pcapngLinkTypeUser0        uint16 = 147 // Raw application bytes, no link layer
+	pcapngOptIfName            uint16 = 2
+	pcapngOptEPBFlags          uint16 = 2
+	pcapngInbound              uint32 = 1
+	pcapngOutbound             uint32 = 2
+)
+
+// frameTrace records the raw bytes read from and written to traced
+// connections as a pcapng stream. Each connection gets its own interface
+// named after its remote address, and every Read or Write becomes an
+// enhanced packet block carrying a timestamp and direction flag.
+type frameTrace struct {
+	mu     sync.Mutex
+	w      io.Writer
+	nextIf uint32
+	now    func() time.Time // Clock for packet timestamps
+}
+
+// newFrameTrace writes the pcapng section header to w.
+func newFrameTrace(w io.Writer) (*frameTrace, error) {
+	t := &frameTrace{w: w, now: time.Now}
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, pcapngByteOrderMagic)
+	binary.Write(body, binary.BigEndian, uint16(1)) // Major version
+	binary.Write(body, binary.BigEndian, uint16(0)) // Minor version
+	binary.Write(body, binary.BigEndian, int64(-1)) // Section length unknown
+	return t, t.writeBlock(pcapngSectionHeader, body.Bytes())
+}
+
+// wrap returns conn with its traffic recorded to the trace.
+func (t *frameTrace) wrap(conn net.Conn) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, pcapngLinkTypeUser0)
+	binary.Write(body, binary.BigEndian, uint16(0)) // Reserved
+	binary.Write(body, binary.BigEndian, uint32(0)) // No snap length
+	writePcapngOption(body, pcapngOptIfName, []byte(conn.RemoteAddr().String()))
+	writePcapngOption(body, 0, nil) // End of options
+	if err := t.writeBlock(pcapngInterfaceDescription, body.Bytes()); err != nil {
+		log.Printf("Error writing frame trace interface for %s: %v", conn.RemoteAddr().String(), err)
+	}
+
+	tc := &traceConn{Conn: conn, trace: t, iface: t.nextIf}
+	t.nextIf++
+	return tc
+}
+
+func (t *frameTrace) packet(iface, direction uint32, data []byte) {
+	ts := uint64(t.now().UnixMicro())
+
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, iface)
+	binary.Write(body, binary.BigEndian, uint32(ts>>32))
+	binary.Write(body, binary.BigEndian, uint32(ts))
+	binary.Write(body, binary.BigEndian, uint32(len(data))) // Captured length
+	binary.Write(body, binary.BigEndian, uint32(len(data))) // Original length
+	body.Write(data)
+	body.Write(make([]byte, pcapngPad(len(data))))
+	flags := make([]byte, 4)
+	binary.BigEndian.PutUint32(flags, direction)
+	writePcapngOption(body, pcapngOptEPBFlags, flags)
+	writePcapngOption(body, 0, nil)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.writeBlock(pcapngEnhancedPacket, body.Bytes()); err != nil {
+		log.Printf("Error writing frame trace packet: %v", err)
+	}
+}
+
+// writeBlock writes a complete pcapng block. Callers must hold t.mu,
+// except while the trace is being created.
+func (t *frameTrace) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, blockType)
+	binary.Write(buf, binary.BigEndian, total)
+	buf.Write(body)
+	binary.Write(buf, binary.BigEndian, total)
+	_, err := t.w.Write(buf.Bytes())
+	return err
+}
+
+func writePcapngOption(buf *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buf, binary.BigEndian, code)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(make([]byte, pcapngPad(len(value))))
+}
+
+// pcapngPad returns the padding needed to align n bytes to 32 bits.
+func pcapngPad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// traceConn is a net.Conn that records its traffic to a frameTrace.
+type traceConn struct {
+	net.Conn
+	trace *frameTrace
+	iface uint32
+}
+
+func (c *traceConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.trace.packet(c.iface, pcapngInbound, p[:n])
+	}
+	return n, err
+}
+
+func (c *traceConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.trace.packet(c.iface, pcapngOutbound, p[:n])
+	}
+	return n, err
+}
+
+// englishMessages holds the built-in text for every user-visible server
+// message, keyed by message ID. Values are text/template sources.
+var englishMessages = map[string]string{
+	"joined":           "{{.Name}} joined the room",
+	"left":             "{{.Name}} left the room",
+	"left_custom":      "{{.Name}} left: {{.Text}}",
+	"left_goodbye":     "{{.Name}} left (said goodbye)",
+	"left_kicked":      "{{.Name}} was removed by an admin",
+	"announcement":     "[announcement] {{.Text}}",
+	"version":          "Protocol: {{.Protocol}} | Server: {{.Server}} | Go: {{.Go}} | Built: {{.Built}}",
+	"leavemsg_cleared": "leave message cleared",
+	"leavemsg_set":     "leave message set to: {{.Text}}",
+	"unknown_command":  "unknown command {{.Command}}",
+	"server_full":      "server is full, try again later",
+	"starting_up":      "server is starting up, you will join shortly",
+	"recent_joined":    "{{.Time}} {{.Name}} joined",
+	"recent_left":      "{{.Time}} {{.Name}} left",
+	"recent_none":      "no recent joins or leaves",
+	"recent_usage":     "usage: /recent [count]",
+	"blank_message":    "empty message not sent",
+	"nick_usage":       "usage: /nick <name>",
+	"nick_invalid":     "nicknames are 1-{{.Max}} letters, digits, '_' or '-'",
+	"nick_taken":       "{{.Name}} is already taken",
+	"nick_reserved":    "{{.Name}} is a reserved name",
+	"nick_set":         "you are now known as {{.Name}}",
+	"nick_changed":     "{{.Old}} is now known as {{.Name}}",
+	"quietjoins_on":    "join and leave notices are now hidden",
+	"quietjoins_off":   "join and leave notices are now shown",
+	"conninfo":         "connected {{.Connected}} | you sent {{.FramesIn}} messages ({{.BytesIn}} bytes) | you received {{.FramesOut}} messages ({{.BytesOut}} bytes) | {{.Dropped}} not delivered",
+	"namehist_usage":   "usage: /namehistory, lists your own earlier names",
+	"namehistory":      "{{.Name}} has been known as {{.Names}}",
+	"namehistory_none": "{{.Name}} has not changed name",
+	"no_such_user":     "no user named {{.Name}}",
+	"idle_away":        "{{.Names}} {{if eq .Count 1}}is{{else}}are{{end}} now away (idle)",
+	"idle_back":        "{{.Name}} is back",
+	"archive_on":       "your messages will be copied to {{.Name}}",
+	"archive_off":      "your messages are no longer copied",
+	"archive_self":     "you cannot archive to yourself",
+	"archive_copy":     "[archive] {{.Message}}",
+	"archive_gone":     "{{.Name}} left, your messages are no longer copied",
+	"exceptmsg_usage":  "usage: /exceptmsg <name,name,...> <message>",
+	"presence_summary": "{{if .Joined}}{{.Joined}} {{if eq .Joined 1}}user{{else}}users{{end}} joined{{end}}{{if and .Joined .Left}}, {{end}}{{if .Left}}{{.Left}} left{{end}}",
+	"tz_current":       "timestamps are shown in {{.Zone}}, use /tz <zone> to change",
+	"tz_set":           "timestamps will be shown in {{.Zone}}",
+	"tz_unknown":       "unknown time zone {{.Zone}}",
+	"who":              "{{.Count}} online: {{.Names}} (page {{.Page}}/{{.Pages}})",
+	"who_usage":        "usage: /who [page], pages 1-{{.Pages}}",
+	"who_away":         "{{.Name}} (away)",
+}
+
+var defaultCatalog = mustCatalog(nil)
+
+// catalog is a set of parsed message templates keyed by message ID.
+type catalog struct {
+	templates map[string]*template.Template
+}
+
+// newCatalog parses overrides on top of the English messages. It returns
+// the IDs that overrides does not translate and the IDs in overrides
+// that are not messages, such as typos, both in sorted order. Unknown
+// IDs are ignored.
+func newCatalog(overrides map[string]string) (c *catalog, missing, unknown []string, err error) {
+	c = &catalog{templates: make(map[string]*template.Template)}
+	for id := range overrides {
+		if _, ok := englishMessages[id]; !ok {
+			unknown = append(unknown, id)
+		}
+	}
+	for id, src := range englishMessages {
+		if o, ok := overrides[id]; ok {
+			src = o
+		} else {
+			missing = append(missing, id)
+		}
+		tmpl, err := template.New(id).Parse(src)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("message %q: %w", id, err)
+		}
+		c.templates[id] = tmpl
+	}
+	sort.Strings(missing)
+	sort.Strings(unknown)
+	return c, missing, unknown, nil
+}
+
+func mustCatalog(overrides map[string]string) *catalog {
+	c, _, _, err := newCatalog(overrides)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// loadCatalog reads a JSON object of message ID to template from path.
+func loadCatalog(path string) (c *catalog, missing, unknown []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return newCatalog(overrides)
+}
+
+// text renders message id with params. Unknown IDs and template errors
+// are logged and fall back to the ID itself.
+func (c *catalog) text(id string, params map[string]any) string {
+	tmpl, ok := c.templates[id]
+	if !ok {
+		log.Printf("ERROR: no message with id %q in catalog", id)
+		return id
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, params); err != nil {
+		log.Printf("Error rendering message %q: %v", id, err)
+		return id
+	}
+	return buf.String()
+}
+
+// eventKind identifies what happened in an event.
+type eventKind int
+
+const (
+	eventMessageReceived    eventKind = iota // A client sent a message or command
+	eventClientConnected                     // A client joined; it is already a member
+	eventClientDisconnected                  // A client left; it is no longer a member
+)
+
+// event describes something that happened in the run loop.
+type event struct {
+	kind   eventKind
+	client *client
+	msg    string // Set for eventMessageReceived
+}
+
+// eventBus lets server features react to run loop events without the
+// loop knowing about them. Handlers run synchronously in the publishing
+// goroutine, which is the run loop, so they may touch server state.
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers map[eventKind][]func(event)
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{handlers: make(map[eventKind][]func(event))}
+}
+
+// subscribe registers handler to be called for every event of kind.
+func (b *eventBus) subscribe(kind eventKind, handler func(event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[kind] = append(b.handlers[kind], handler)
+}
+
+// publish calls the handlers subscribed to e.kind in subscription order.
+func (b *eventBus) publish(e event) {
+	b.mu.RLock()
+	handlers := b.handlers[e.kind]
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// nameGenerator picks names for new clients. Generators don't have to
+// produce unique names; guestName retries and falls back to a numeric
+// suffix until a name is free. They must be safe for concurrent use.
+type nameGenerator interface {
+	generate() string
+}
+
+// numericNames generates names like "user8231".
+type numericNames struct{}
+
+func (numericNames) generate() string {
+	return fmt.Sprintf("user%d", rand.Intn(10000))
+}
+
+var nameAdjectives = []string{
+	"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "curious",
+	"daring", "eager", "fuzzy", "gentle", "happy", "jolly", "keen", "lively",
+	"lucky", "mellow", "nimble", "plucky", "quick", "quiet", "rapid", "shy",
+	"silent", "sleepy", "sunny", "swift", "witty", "zesty",
+}
+
+var nameAnimals = []string{
+	"badger", "beaver", "bison", "crane", "falcon", "ferret", "gecko", "heron",
+	"ibis", "jackal", "koala", "lemur", "lynx", "marmot", "moose", "newt",
+	"ocelot", "otter", "panda", "puffin", "quail", "raven", "seal", "sloth",
+	"tapir", "toucan", "walrus", "wombat", "yak", "zebra",
+}
+
+// wordNames generates names like "curious-otter-42".
+type wordNames struct{}
+
+func (wordNames) generate() string {
+	return fmt.Sprintf("%s-%s-%d", nameAdjectives[rand.Intn(len(nameAdjectives))], nameAnimals[rand.Intn(len(nameAnimals))], rand.Intn(100))
+}
+
+// templateNamePart matches a placeholder in a name template.
+var templateNamePart = regexp.MustCompile(`\{[^{}]*\}`)
+
+// templateNames generates names from a pattern such as
+// "guest-{animal}-{number}", where {adjective} and {animal} are picked
+// from the word lists and {number} is 0-9999.
+type templateNames struct {
+	pattern string
+}
+
+// newTemplateNames checks that pattern only uses known placeholders,
+// varies between names and produces valid nicknames.
+func newTemplateNames(pattern string) (*templateNames, error) {
+	if strings.Count(pattern, "{") != strings.Count(pattern, "}") {
+		return nil, fmt.Errorf("name template %q has unbalanced braces", pattern)
+	}
+	parts := templateNamePart.FindAllString(pattern, -1)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("name template %q has no {adjective}, {animal} or {number} placeholder, so every name would be the same", pattern)
+	}
+	for _, p := range parts {
+		switch p {
+		case "{adjective}", "{animal}", "{number}":
+		default:
+			return nil, fmt.Errorf("name template %q has unknown placeholder %s", pattern, p)
+		}
+	}
+
+	// The longest possible expansion must still be a usable nickname.
+	longest := strings.NewReplacer("{adjective}", "xxxxxxx", "{animal}", "xxxxxx", "{number}", "9999").Replace(pattern)
+	if !validNick(longest) {
+		return nil, fmt.Errorf("name template %q does not produce valid nicknames (1-%d letters, digits, '_' or '-')", pattern, maxNickLen)
+	}
+	return &templateNames{pattern: pattern}, nil
+}
+
+func (t *templateNames) generate() string {
+	return templateNamePart.ReplaceAllStringFunc(t.pattern, func(p string) string {
+		switch p {
+		case "{adjective}":
+			return nameAdjectives[rand.Intn(len(nameAdjectives))]
+		case "{animal}":
+			return nameAnimals[rand.Intn(len(nameAnimals))]
+		default:
+			return strconv.Itoa(rand.Intn(10000))
+		}
+	})
+}
+
+// newNameGenerator returns the generator called kind. pattern is only
+// used by the "template" generator.
+func newNameGenerator(kind, pattern string) (nameGenerator, error) {
+	switch kind {
+	case "numeric":
+		return numericNames{}, nil
+	case "words":
+		return wordNames{}, nil
+	case "template":
+		return newTemplateNames(pattern)
+	}
+	return nil, fmt.Errorf("unknown name generator %q (want numeric, words or template)", kind)
+}
+
+// presenceEvent records a client joining or leaving.
+type presenceEvent struct {
+	name   string
+	joined bool
+	at     time.Time
+}
+
 type server struct {
-	members    map[net.Addr]*client
-	messages   chan message
-	disconnect chan net.Addr // Channel to handle client disconnection
+	members        map[net.Addr]*client
+	byName         map[string]*client // Members by nameKey; changed only by register, rename and deregister
+	checkNames     bool               // Verify members and byName agree after every change
+	messages       chan message
+	join           chan *client  // Channel to register newly accepted clients
+	disconnect     chan net.Addr // Channel to handle client disconnection
+	events         *eventBus     // Run loop events for features to subscribe to
+	ready          chan struct{} // Closed once warm-up is over and clients may join
+	admin          chan adminRequest
+	adminFailures  sync.Mutex         // Held through each failed admin login, so guesses are one per adminFailDelay
+	flush          chan chan struct{} // Each channel sent is closed once everything before it is handled
+	asciiOnly      bool               // Reject messages that are not printable 7-bit ASCII
+	halfCloseGrace time.Duration      // Longest wait for replies after a client stops sending
+	blankNotice    string             // Notice for dropped whitespace-only messages, empty for none
+	maxInvalidUTF8 int                // Consecutive invalid UTF-8 messages before disconnecting, 0 never
+	wrongProtocol  atomic.Int64       // Connections rejected for speaking another protocol
+	catalog        *catalog           // User-visible server messages
+	recent         []presenceEvent
+	recentSize     int                 // Maximum number of presence events kept in recent
+	nickLimit      int                 // Renames allowed per connection within nickWindow, 0 for no limit
+	nickWindow     time.Duration       // Window for nickLimit
+	reservedNames  map[string]struct{} // Names nobody may use, by nameKey
+	names          nameGenerator       // Picks names for new clients
+	idleAway       time.Duration       // Mark members away after this long without chat, 0 to disable
+	presenceWindow time.Duration       // Coalesce join/leave notices within this window, 0 to disable
+
+	// Join/leave notices held back by announcePresence until presenceFlush fires.
+	presenceFlush               <-chan time.Time
+	pendingJoins, pendingLeaves int
+	pendingSender               *client
+	pendingMsg                  string
+
+	// When adaptiveMinClients is set, messageLimit is recomputed with
+	// limitFunc whenever a client joins or leaves.
+	messageLimit       atomic.Uint32
+	adaptiveMinClients int
+	limitFunc          func(base uint32, minClients, clients int) uint32
 }
 
 func (s *server) run() {
+	var idleCheck <-chan time.Time
+	if s.idleAway > 0 {
+		ticker := time.NewTicker(max(s.idleAway/10, time.Second))
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
 	for {
 		select {
+		case <-idleCheck:
+			s.markIdle()
+		case <-s.presenceFlush:
+			s.flushPresence()
 		case msg := <-s.messages:
+			s.events.publish(event{kind: eventMessageReceived, client: msg.client, msg: msg.msg})
 			s.msg(msg.client, msg.msg)
+		case c := <-s.join:
+			s.admit(c)
+		case req := <-s.admin:
+			req.reply <- s.adminCommand(req.line)
+		case done := <-s.flush:
+			close(done)
 		case addr := <-s.disconnect:
 			// Handle client disconnection
 			if client, ok := s.members[addr]; ok {
-				s.broadcast(client, fmt.Sprintf("%s left the room", client.name))
-				delete(s.members, addr)
+				if client.kicked {
+					s.announcePresence(client, false, s.text("left_kicked", map[string]any{"Name": client.name}))
+				} else if client.leaveMsg != "" {
+					s.announcePresence(client, false, s.text("left_custom", map[string]any{"Name": client.name, "Text": client.leaveMsg}))
+				} else if client.saidGoodbye {
+					s.announcePresence(client, false, s.text("left_goodbye", map[string]any{"Name": client.name}))
+				} else {
+					s.announcePresence(client, false, s.text("left", map[string]any{"Name": client.name}))
+				}
+				s.deregister(client)
+				s.events.publish(event{kind: eventClientDisconnected, client: client})
 			}
 		}
 	}
 }
 
+// announcePresence delivers the join or leave notice msg for c. With a
+// presence window set, notices are held back and everything that
+// happens within the window is summed up in one notice instead.
+func (s *server) announcePresence(c *client, joined bool, msg string) {
+	if s.presenceWindow <= 0 {
+		s.broadcastPresence(c, msg)
+		return
+	}
+
+	if s.pendingJoins+s.pendingLeaves == 0 {
+		s.pendingSender, s.pendingMsg = c, msg
+		s.presenceFlush = time.After(s.presenceWindow)
+	}
+	if joined {
+		s.pendingJoins++
+	} else {
+		s.pendingLeaves++
+	}
+}
+
+// flushPresence sends the notices held back by announcePresence. A lone
+// event keeps its own notice; more become a single summary.
+func (s *server) flushPresence() {
+	if s.pendingJoins+s.pendingLeaves == 1 {
+		s.broadcastPresence(s.pendingSender, s.pendingMsg)
+	} else {
+		s.broadcastPresence(nil, s.text("presence_summary", map[string]any{"Joined": s.pendingJoins, "Left": s.pendingLeaves}))
+	}
+	s.pendingJoins, s.pendingLeaves = 0, 0
+	s.pendingSender, s.pendingMsg = nil, ""
+	s.presenceFlush = nil
+}
+
+// markIdle marks members who have not chatted for idleAway as away and
+// tells the room with a single notice, however many went idle at once.
+func (s *server) markIdle() {
+	var names []string
+	for _, m := range s.members {
+		if !m.away && time.Since(m.lastActivity) >= s.idleAway {
+			m.away = true
+			names = append(names, m.name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	s.broadcastTo(nil, s.text("idle_away", map[string]any{"Names": strings.Join(names, ", "), "Count": len(names)}), nil)
+}
+
+// updateMessageLimit recomputes the message size limit for the current
+// number of members when adaptive limits are enabled.
+func (s *server) updateMessageLimit() {
+	if s.adaptiveMinClients <= 0 {
+		return
+	}
+	limit := s.limitFunc(maxMessageSize, s.adaptiveMinClients, len(s.members))
+	if old := s.messageLimit.Swap(limit); old != limit {
+		log.Printf("Message size limit is now %d bytes for %d clients", limit, len(s.members))
+	}
+}
+
+// linearMessageLimit is the default adaptive limit: base up to minClients,
+// falling linearly to base/4 at 10*minClients and staying there.
+func linearMessageLimit(base uint32, minClients, clients int) uint32 {
+	if clients <= minClients {
+		return base
+	}
+	if clients >= 10*minClients {
+		return base / 4
+	}
+	reduction := uint64(base-base/4) * uint64(clients-minClients) / uint64(9*minClients)
+	return base - uint32(reduction)
+}
+
+// recordPresence appends a join or leave of c to the bounded recent log.
+func (s *server) recordPresence(c *client, joined bool) {
+	if s.recentSize <= 0 {
+		return
+	}
+	s.recent = append(s.recent, presenceEvent{name: c.name, joined: joined, at: time.Now()})
+	if len(s.recent) > s.recentSize {
+		s.recent = s.recent[len(s.recent)-s.recentSize:]
+	}
+}
+
 func (s *server) newClient(conn net.Conn) *client {
 	return &client{
-		conn:          conn,
-		name:          fmt.Sprintf("user%d", time.Now().UnixNano()%10000),
-		serverMessage: s.messages, // Give the client access to the server channel
-		disconnect:    s.disconnect,
+		conn:           conn,
+		name:           s.guestName(nil),
+		serverMessage:  s.messages, // Give the client access to the server channel
+		disconnect:     s.disconnect,
+		flush:          s.flush,
+		halfCloseGrace: s.halfCloseGrace,
+		writeFailed:    make(chan struct{}),
+		blankNotice:    s.blankNotice,
+		maxInvalidUTF8: s.maxInvalidUTF8,
+		wrongProtocol:  &s.wrongProtocol,
+		messageLimit:   &s.messageLimit,
+		location:       time.Local,
+		connectedAt:    time.Now(),
+		lastActivity:   time.Now(),
 	}
 }
 
 func (s *server) msg(c *client, msg string) {
+	if s.asciiOnly && !isPrintableASCII(msg) {
+		log.Printf("Rejecting non-ASCII message from %s", c.name)
+		c.msg("INVALID_CHARSET")
+		return
+	}
+
+	if strings.HasPrefix(msg, "/") {
+		s.command(c, msg)
+		return
+	}
+
+	s.chat(c, msg, nil)
+}
+
+// chat sends msg from c to the members include accepts, or to everyone
+// if include is nil, and copies it to c's archive target.
+func (s *server) chat(c *client, msg string, include func(m *client) bool) {
+	c.lastActivity = time.Now()
+	if c.away {
+		c.away = false
+		s.broadcast(c, s.text("idle_back", map[string]any{"Name": c.name}))
+	}
+
 	// Send the message directly to all clients
 	chatMsg := fmt.Sprintf("%s: %s", c.name, msg)
-	s.broadcast(c, chatMsg)
+	s.broadcastTo(c, chatMsg, include)
+
+	if c.archiveTo != nil && !c.archiveTo.closed.Load() && (include == nil || include(c.archiveTo)) {
+		c.archiveTo.msg(s.text("archive_copy", map[string]any{"Message": chatMsg}))
+	}
+}
+
+// dropArchiveTarget stops copying messages to c, which has left, so
+// whoever takes its name next does not receive them.
+func (s *server) dropArchiveTarget(c *client) {
+	for _, m := range s.members {
+		if m.archiveTo == c {
+			m.archiveTo = nil
+			m.msg(s.text("archive_gone", map[string]any{"Name": c.name}))
+		}
+	}
+}
+
+// memberByName returns the member called name, ignoring case, or nil.
+func (s *server) memberByName(name string) *client {
+	return s.byName[nameKey(name)]
+}
+
+// nameKey folds name to the byName key, so names that strings.EqualFold
+// considers equal share a key. ToLower alone is not enough: "aσ" and
+// "aς" are equal under EqualFold but lower-case differently.
+func nameKey(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// register adds c to the members under its current name, which must not
+// be taken. Like rename and deregister, only the run loop may call it.
+func (s *server) register(c *client) {
+	s.members[c.conn.RemoteAddr()] = c
+	s.byName[nameKey(c.name)] = c
+	s.verifyNames()
+}
+
+// rename changes the name of member c to name, which must not be taken.
+func (s *server) rename(c *client, name string) {
+	delete(s.byName, nameKey(c.name))
+	c.setName(name)
+	s.byName[nameKey(name)] = c
+	s.verifyNames()
+}
+
+// deregister removes c from the members.
+func (s *server) deregister(c *client) {
+	delete(s.members, c.conn.RemoteAddr())
+	if s.byName[nameKey(c.name)] == c {
+		delete(s.byName, nameKey(c.name))
+	}
+	s.verifyNames()
+}
+
+// verifyNames panics unless every member has exactly one byName entry
+// and byName holds nothing else. It only runs with checkNames set, as it
+// costs a pass over all members.
+func (s *server) verifyNames() {
+	if !s.checkNames {
+		return
+	}
+	if len(s.byName) != len(s.members) {
+		log.Panicf("name registry out of sync: %d names for %d members", len(s.byName), len(s.members))
+	}
+	for addr, m := range s.members {
+		if s.byName[nameKey(m.name)] != m {
+			log.Panicf("name registry out of sync: member %s (%s) is not registered under its name", m.name, addr)
+		}
+	}
+}
+
+// text renders the catalog message id with the given parameters.
+func (s *server) text(id string, params map[string]any) string {
+	return s.catalog.text(id, params)
+}
+
+// command handles a slash command sent by c. Replies go only to c.
+func (s *server) command(c *client, line string) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/version":
+		c.msg(s.text("version", map[string]any{"Protocol": protocolVersion, "Server": version, "Go": runtime.Version(), "Built": buildTime}))
+	case "/protocol":
+		c.msg(s.protocolInfo(c))
+	case "/leavemsg":
+		c.leaveMsg = sanitizeLeaveMsg(strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		if c.leaveMsg == "" {
+			c.msg(s.text("leavemsg_cleared", nil))
+		} else {
+			c.msg(s.text("leavemsg_set", map[string]any{"Text": c.leaveMsg}))
+		}
+	case "/quit":
+		// Closing the connection ends the reader, which reports the
+		// disconnect back to the run loop as usual.
+		c.saidGoodbye = true
+		c.closed.Store(true)
+		c.conn.Close()
+	case "/nick":
+		if len(fields) != 2 {
+			c.msg(s.text("nick_usage", nil))
+			return
+		}
+		s.nick(c, fields[1])
+	case "/quietjoins":
+		c.quietJoins = !c.quietJoins
+		if c.quietJoins {
+			c.msg(s.text("quietjoins_on", nil))
+		} else {
+			c.msg(s.text("quietjoins_off", nil))
+		}
+	case "/conninfo":
+		c.msg(s.text("conninfo", map[string]any{
+			"Connected": time.Since(c.connectedAt).Round(time.Second),
+			"FramesIn":  c.framesIn.Load(),
+			"BytesIn":   c.bytesIn.Load(),
+			"FramesOut": c.framesOut.Load(),
+			"BytesOut":  c.bytesOut.Load(),
+			"Dropped":   c.dropped.Load(),
+		}))
+	case "/namehistory":
+		// Other members' earlier names are only shown on the admin port;
+		// renaming would be pointless if anyone could look them up.
+		if len(fields) != 1 {
+			c.msg(s.text("namehist_usage", nil))
+			return
+		}
+		c.msg(s.nameHistory(c))
+	case "/archive":
+		if len(fields) == 1 {
+			c.archiveTo = nil
+			c.msg(s.text("archive_off", nil))
+			return
+		}
+		target := s.memberByName(fields[1])
+		if target == nil {
+			c.msg(s.text("no_such_user", map[string]any{"Name": fields[1]}))
+			return
+		}
+		if target == c {
+			c.msg(s.text("archive_self", nil))
+			return
+		}
+		c.archiveTo = target
+		c.msg(s.text("archive_on", map[string]any{"Name": target.name}))
+	case "/tz":
+		if len(fields) != 2 {
+			c.msg(s.text("tz_current", map[string]any{"Zone": c.location.String()}))
+			return
+		}
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			c.msg(s.text("tz_unknown", map[string]any{"Zone": fields[1]}))
+			return
+		}
+		c.location = loc
+		c.msg(s.text("tz_set", map[string]any{"Zone": loc.String()}))
+	case "/recent":
+		s.sendRecent(c, fields[1:])
+	case "/who":
+		s.sendWho(c, fields[1:])
+	case "/exceptmsg":
+		if len(fields) < 3 {
+			c.msg(s.text("exceptmsg_usage", nil))
+			return
+		}
+		except := make(map[*client]bool)
+		for _, name := range strings.Split(fields[1], ",") {
+			m := s.memberByName(name)
+			if m == nil {
+				c.msg(s.text("no_such_user", map[string]any{"Name": name}))
+				return
+			}
+			except[m] = true
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		text := strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+		s.chat(c, text, func(m *client) bool { return !except[m] })
+	default:
+		c.msg(s.text("unknown_command", map[string]any{"Command": fields[0]}))
+	}
+}
+
+// protocolInfo describes the wire format as this server is configured,
+// as space-separated key=value pairs for clients to parse.
+func (s *server) protocolInfo(c *client) string {
+	charset := "utf-8"
+	if s.asciiOnly {
+		charset = "ascii"
+	}
+	return fmt.Sprintf("PROTOCOL version=%d length_prefix=4 byte_order=big_endian type_byte=false max_size=%d current_limit=%d charset=%s max_invalid_utf8=%d half_close_grace=%s",
+		protocolVersion, maxMessageSize, c.messageLimit.Load(), charset, c.maxInvalidUTF8, c.halfCloseGrace)
+}
+
+// nick renames c to name if it is valid, free and c has not used up its
+// renames for the current window. It runs in the run loop, so the
+// uniqueness check and the rename cannot race with another /nick.
+func (s *server) nick(c *client, name string) {
+	if !validNick(name) {
+		c.msg(s.text("nick_invalid", map[string]any{"Max": maxNickLen}))
+		return
+	}
+	if s.isReservedName(name) {
+		c.msg(s.text("nick_reserved", map[string]any{"Name": name}))
+		return
+	}
+	if s.nameTaken(name, c) {
+		c.msg(s.text("nick_taken", map[string]any{"Name": name}))
+		return
+	}
+
+	now := time.Now()
+	if s.nickLimit > 0 {
+		var recent []rename
+		for _, r := range c.renames {
+			if now.Sub(r.at) < s.nickWindow {
+				recent = append(recent, r)
+			}
+		}
+		if len(recent) >= s.nickLimit {
+			wait := s.nickWindow - now.Sub(recent[len(recent)-s.nickLimit].at)
+			c.msg(fmt.Sprintf("NICK_RATE_LIMITED: next change allowed in %s", wait.Round(time.Second)))
+			return
+		}
+	}
+
+	old := c.name
+	s.rename(c, name)
+	c.renames = append(c.renames, rename{from: old, to: name, at: now})
+	log.Printf("Client %s (%s) renamed from %s to %s", name, c.conn.RemoteAddr().String(), old, name)
+	c.msg(s.text("nick_set", map[string]any{"Name": name}))
+	s.broadcast(c, s.text("nick_changed", map[string]any{"Old": old, "Name": name}))
+}
+
+// maxNameAttempts bounds how many generated names guestName tries before
+// it falls back to a numeric suffix, so a small name space or a long
+// reserved list cannot stall the run loop.
+const maxNameAttempts = 20
+
+// guestName returns a generated name that is not reserved and that taken,
+// if not nil, does not report as taken. If none of maxNameAttempts
+// generated names is free, the last one gets the lowest free suffix
+// "-2", "-3" and so on.
+func (s *server) guestName(taken func(name string) bool) string {
+	free := func(name string) bool {
+		return !s.isReservedName(name) && (taken == nil || !taken(name))
+	}
+	var name string
+	for i := 0; i < maxNameAttempts; i++ {
+		if name = s.names.generate(); free(name) {
+			return name
+		}
+	}
+	for n := 2; ; n++ {
+		if suffixed := fmt.Sprintf("%s-%d", name, n); free(suffixed) {
+			return suffixed
+		}
+	}
+}
+
+// admit makes c a member and announces it. Guest names are picked
+// outside the run loop, so c gets a new one if somebody took its name in
+// the meantime.
+func (s *server) admit(c *client) {
+	if s.nameTaken(c.name, c) {
+		c.setName(s.guestName(func(name string) bool { return s.nameTaken(name, c) }))
+	}
+	s.register(c)
+	s.events.publish(event{kind: eventClientConnected, client: c})
+	s.announcePresence(c, true, s.text("joined", map[string]any{"Name": c.name}))
+}
+
+// nameTaken reports whether a member other than except uses name,
+// ignoring case. Only the run loop may call it, and a rename must happen
+// in the same run loop step as the check so two clients can never end
+// up with the same name.
+func (s *server) nameTaken(name string, except *client) bool {
+	m, ok := s.byName[nameKey(name)]
+	return ok && m != except
+}
+
+// isReservedName reports whether name is one of the reserved names,
+// folded with nameKey just as member names are.
+func (s *server) isReservedName(name string) bool {
+	_, ok := s.reservedNames[nameKey(name)]
+	return ok
+}
+
+// nameHistory describes every name member m has used, oldest first.
+func (s *server) nameHistory(m *client) string {
+	if len(m.renames) == 0 {
+		return s.text("namehistory_none", map[string]any{"Name": m.name})
+	}
+	names := []string{m.renames[0].from}
+	for _, r := range m.renames {
+		names = append(names, r.to)
+	}
+	return s.text("namehistory", map[string]any{"Name": m.name, "Names": strings.Join(names, " -> ")})
+}
+
+// validNick reports whether name is 1-maxNickLen letters, digits, '_' or '-'.
+func validNick(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > maxNickLen {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// sendRecent replies to c with the last n presence events, oldest first.
+// n defaults to 10 and is read from args if given.
+func (s *server) sendRecent(c *client, args []string) {
+	n := 10
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v <= 0 {
+			c.msg(s.text("recent_usage", nil))
+			return
+		}
+		n = v
+	}
+	if len(s.recent) == 0 {
+		c.msg(s.text("recent_none", nil))
+		return
+	}
+
+	events := s.recent[max(len(s.recent)-n, 0):]
+	for _, e := range events {
+		id := "recent_left"
+		if e.joined {
+			id = "recent_joined"
+		}
+		c.msg(s.text(id, map[string]any{"Time": e.at.In(c.location).Format("15:04:05"), "Name": e.name}))
+	}
+}
+
+// sendWho replies to c with one page of member names in alphabetical
+// order. The page defaults to 1 and is read from args if given.
+func (s *server) sendWho(c *client, args []string) {
+	names := make([]string, 0, len(s.members))
+	for _, m := range s.members {
+		if m.away {
+			names = append(names, s.text("who_away", map[string]any{"Name": m.name}))
+		} else {
+			names = append(names, m.name)
+		}
+	}
+	sort.Strings(names)
+
+	// Fill each page with as many names as fit in whoPageBytes.
+	var pages [][]string
+	size := 0
+	for _, name := range names {
+		if len(pages) == 0 || size+len(", ")+len(name) > whoPageBytes {
+			pages = append(pages, nil)
+			size = -len(", ")
+		}
+		pages[len(pages)-1] = append(pages[len(pages)-1], name)
+		size += len(", ") + len(name)
+	}
+
+	page := 1
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < 1 || v > len(pages) || len(args) > 1 {
+			c.msg(s.text("who_usage", map[string]any{"Pages": len(pages)}))
+			return
+		}
+		page = v
+	}
+	c.msg(s.text("who", map[string]any{
+		"Count": len(names),
+		"Names": strings.Join(pages[page-1], ", "),
+		"Page":  page,
+		"Pages": len(pages),
+	}))
+}
+
+// sanitizeLeaveMsg drops control characters from msg and truncates it to
+// maxLeaveMsgLen runes.
+func sanitizeLeaveMsg(msg string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range msg {
+		if unicode.IsControl(r) {
+			continue
+		}
+		if n == maxLeaveMsgLen {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// isPrintableASCII reports whether msg only contains printable ASCII
+// (0x20-0x7E) plus newline, carriage return and tab.
+func isPrintableASCII(msg string) bool {
+	for i := 0; i < len(msg); i++ {
+		b := msg[i]
+		if b == '\n' || b == '\r' || b == '\t' {
+			continue
+		}
+		if b < 0x20 || b > 0x7E {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *server) broadcast(sender *client, msg string) {
-	log.Printf("Broadcasting: '%s' (originated from %s)", msg, sender.name) // Verbose Log
+	s.broadcastTo(sender, msg, nil)
+}
+
+// broadcastPresence sends a join or leave notice to every member except
+// the sender and those who turned presence notices off with /quietjoins.
+func (s *server) broadcastPresence(sender *client, msg string) {
+	s.broadcastTo(sender, msg, func(m *client) bool { return !m.quietJoins })
+}
+
+// broadcastTo sends msg to every member except the sender for which
+// include returns true. A nil include sends to all of them, and a nil
+// sender marks a notice from the server itself.
+func (s *server) broadcastTo(sender *client, msg string, include func(m *client) bool) {
+	from := "server"
+	if sender != nil {
+		from = sender.name
+	}
+	log.Printf("Broadcasting: '%s' (originated from %s)", msg, from) // Verbose Log
 	count := 0
 	for addr, m := range s.members {
 		// Don't send back to sender
-		if sender.conn.RemoteAddr() != addr {
+		if (sender == nil || sender.conn.RemoteAddr() != addr) && !m.closed.Load() && (include == nil || include(m)) {
 			m.msg(msg) // Use the client's msg method
 			count++
 		}
@@ -186,46 +1430,624 @@ func (s *server) broadcast(sender *client, msg string) {
 }
 
 func newServer() *server {
-	return &server{
-		members:    make(map[net.Addr]*client),
-		messages:   make(chan message),
-		disconnect: make(chan net.Addr),
+	s := &server{
+		members:       make(map[net.Addr]*client),
+		byName:        make(map[string]*client),
+		messages:      make(chan message),
+		join:          make(chan *client),
+		disconnect:    make(chan net.Addr),
+		events:        newEventBus(),
+		ready:         make(chan struct{}),
+		admin:         make(chan adminRequest),
+		flush:         make(chan chan struct{}),
+		catalog:       defaultCatalog,
+		recentSize:    50,
+		nickLimit:     3,
+		nickWindow:    10 * time.Minute,
+		reservedNames: make(map[string]struct{}),
+		names:         numericNames{},
+		idleAway:      15 * time.Minute,
+		limitFunc:     linearMessageLimit,
+	}
+	s.messageLimit.Store(maxMessageSize)
+
+	s.events.subscribe(eventClientConnected, func(e event) {
+		s.recordPresence(e.client, true)
+		s.updateMessageLimit()
+	})
+	s.events.subscribe(eventClientDisconnected, func(e event) {
+		s.recordPresence(e.client, false)
+		s.updateMessageLimit()
+		s.dropArchiveTarget(e.client)
+	})
+	return s
+}
+
+// maxAcceptRate is the highest -accept-rate. newAcceptLimiter refills
+// one token every second/rate, which must stay well above zero.
+const maxAcceptRate = 1000000
+
+// newAcceptLimiter returns a channel that yields up to rate tokens a
+// second. Unused tokens are saved up to rate, so short bursts of
+// connections are not slowed down.
+func newAcceptLimiter(rate int) <-chan struct{} {
+	tokens := make(chan struct{}, rate)
+	for i := 0; i < rate; i++ {
+		tokens <- struct{}{}
+	}
+	go func() {
+		for range time.Tick(time.Second / time.Duration(rate)) {
+			select {
+			case tokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return tokens
+}
+
+// adminRequest is an admin command for the run loop to carry out. The
+// result is sent on reply.
+type adminRequest struct {
+	line  string
+	reply chan<- string
+}
+
+// adminAuthTimeout is how long an admin connection has to send its
+// "auth" frame.
+const adminAuthTimeout = 10 * time.Second
+
+// adminFailDelay is how long a failed admin login waits before it is
+// answered and closed. Failures from all connections wait in turn.
+const adminFailDelay = time.Second
+
+// serveAdminPort accepts admin connections on ln until it is closed.
+func (s *server) serveAdminPort(ln net.Listener, password string) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("unable to accept admin connections: %s", err.Error())
+			continue
+		}
+		go s.serveAdmin(conn, password)
 	}
 }
 
+// serveAdmin handles one connection to the admin port, using the same
+// framing as chat. The first frame must be "auth <password>"; each frame
+// after that is an admin command, answered with one frame. A connection
+// gets one attempt at the password.
+func (s *server) serveAdmin(conn net.Conn, password string) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+
+	conn.SetReadDeadline(time.Now().Add(adminAuthTimeout))
+	line, err := readFrame(conn)
+	if err != nil {
+		log.Printf("Error reading from admin connection %s: %v\n", addr, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	given, ok := strings.CutPrefix(line, "auth ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+		log.Printf("Admin connection %s failed to authenticate\n", addr)
+		s.adminFailures.Lock()
+		time.Sleep(adminFailDelay)
+		s.adminFailures.Unlock()
+		writeFrame(conn, "AUTH_FAILED")
+		return
+	}
+	log.Printf("Admin connection %s authenticated\n", addr)
+	if err := writeFrame(conn, "OK authenticated"); err != nil {
+		return
+	}
+
+	for {
+		line, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading from admin connection %s: %v\n", addr, err)
+			}
+			return
+		}
+		log.Printf("Admin %s: %s\n", addr, line)
+		reply := make(chan string, 1)
+		s.admin <- adminRequest{line: line, reply: reply}
+		if err := writeFrame(conn, <-reply); err != nil {
+			log.Printf("Error writing to admin connection %s: %v\n", addr, err)
+			return
+		}
+	}
+}
+
+// adminCommand runs one admin command in the run loop and returns the
+// reply, starting with OK or ERROR.
+func (s *server) adminCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "ERROR empty command"
+	}
+	switch fields[0] {
+	case "kick":
+		if len(fields) != 2 {
+			return "ERROR usage: kick <name>"
+		}
+		m := s.memberByName(fields[1])
+		if m == nil {
+			return fmt.Sprintf("ERROR no member named %s", fields[1])
+		}
+		// The reader sees the closed connection and reports the
+		// disconnect, which announces the kick.
+		m.kicked = true
+		m.closed.Store(true)
+		m.conn.Close()
+		return fmt.Sprintf("OK kicked %s", m.name)
+	case "announce":
+		text := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		if text == "" {
+			return "ERROR usage: announce <message>"
+		}
+		s.broadcast(nil, s.text("announcement", map[string]any{"Text": text}))
+		return fmt.Sprintf("OK announced to %d members", len(s.members))
+	case "stats":
+		return fmt.Sprintf("OK members=%d message_limit=%d wrong_protocol=%d", len(s.members), s.messageLimit.Load(), s.wrongProtocol.Load())
+	case "namehistory":
+		if len(fields) != 2 {
+			return "ERROR usage: namehistory <name>"
+		}
+		m := s.memberByName(fields[1])
+		if m == nil {
+			return fmt.Sprintf("ERROR no member named %s", fields[1])
+		}
+		return "OK " + s.nameHistory(m)
+	}
+	return fmt.Sprintf("ERROR unknown command %s, expected kick, announce, stats or namehistory", fields[0])
+}
+
+// readFrame reads one length-prefixed frame from r.
+func readFrame(r io.Reader) (string, error) {
+	var msgLen uint32
+	if err := binary.Read(r, binary.BigEndian, &msgLen); err != nil {
+		return "", err
+	}
+	if msgLen == 0 || msgLen > maxMessageSize {
+		return "", fmt.Errorf("invalid frame length %d", msgLen)
+	}
+	buf := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeFrame writes msg to w as one length-prefixed frame.
+func writeFrame(w io.Writer, msg string) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(len(msg)))
+	buf.WriteString(msg)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// startupCheck logs one line of the startup checklist, exiting with err
+// if the check failed.
+func startupCheck(what string, err error) {
+	if err != nil {
+		log.Printf("[FAIL] %s", what)
+		log.Fatalf("unable to start server: %v", err)
+	}
+	log.Printf("[ ok ] %s", what)
+}
+
+// listenError explains why addr could not be listened on in terms a new
+// user can act on.
+func listenError(addr string, err error) error {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		held := ""
+		if pids := listenerPIDs(addr); len(pids) > 0 {
+			held = fmt.Sprintf(" by pid %s", strings.Join(pids, ", "))
+		}
+		return fmt.Errorf("address %s is already in use%s; is another instance running? Stop it or pick another address with -addr", addr, held)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("not allowed to listen on %s; ports below 1024 usually need root, pick another with -addr", addr)
+	}
+	return err
+}
+
+// listenerPIDs returns the IDs of processes with a TCP socket listening
+// on the port of addr. It reads /proc, so it only finds anything on
+// Linux, and only processes we may inspect.
+func listenerPIDs(addr string) []string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil
+	}
+
+	// Lines in /proc/net/tcp look like
+	// "0: 00000000:1F90 00000000:0000 0A ... <inode> ...", where 0A is LISTEN.
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			f := strings.Fields(line)
+			if len(f) < 10 || f[3] != "0A" || !strings.HasSuffix(f[1], fmt.Sprintf(":%04X", p)) {
+				continue
+			}
+			inodes["socket:["+f[9]+"]"] = true
+		}
+	}
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	seen := make(map[string]bool)
+	var pids []string
+	for _, fd := range fds {
+		if target, err := os.Readlink(fd); err == nil && inodes[target] {
+			pid := strings.Split(fd, "/")[2]
+			if !seen[pid] {
+				seen[pid] = true
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids
+}
+
+// config holds the server settings taken from the command line.
+type config struct {
+	addr               string
+	asciiOnly          bool
+	halfCloseGrace     time.Duration
+	langFile           string
+	maxConns           int
+	queueConns         bool
+	adaptiveMinClients int
+	presenceWindow     time.Duration
+	idleAway           time.Duration
+	nickLimit          int
+	nickWindow         time.Duration
+	nameGenerator      string
+	nameTemplate       string
+	reservedNames      string
+	notifyBlank        bool
+	maxInvalidUTF8     int
+	recentSize         int
+	frameTrace         string
+	warmup             time.Duration
+	acceptRate         int
+	adminAddr          string
+	adminPassword      string
+	checkNames         bool
+}
+
+// apply checks every setting and configures s with them. It returns all
+// problems found rather than stopping at the first, each prefixed with
+// the flag it concerns. apply only reads files, so -validate can run it
+// without side effects.
+func (cfg *config) apply(s *server) []error {
+	var errs []error
+	fail := func(flagName, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("-%s: %s", flagName, fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.addr); err != nil {
+		fail("addr", "must be host:port or :port, got %q", cfg.addr)
+	}
+	if cfg.adminAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.adminAddr); err != nil {
+			fail("admin-addr", "must be host:port or :port, got %q", cfg.adminAddr)
+		}
+		if cfg.adminPassword == "" {
+			fail("admin-password", "must be set when -admin-addr is used")
+		}
+	}
+	for _, d := range []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"half-close-grace", cfg.halfCloseGrace},
+		{"presence-window", cfg.presenceWindow},
+		{"idle-away", cfg.idleAway},
+		{"warmup", cfg.warmup},
+	} {
+		if d.value < 0 {
+			fail(d.flag, "must not be negative, got %s", d.value)
+		}
+	}
+	for _, n := range []struct {
+		flag  string
+		value int
+	}{
+		{"max-conns", cfg.maxConns},
+		{"accept-rate", cfg.acceptRate},
+		{"adaptive-min-clients", cfg.adaptiveMinClients},
+		{"nick-limit", cfg.nickLimit},
+		{"recent-size", cfg.recentSize},
+		{"max-invalid-utf8", cfg.maxInvalidUTF8},
+	} {
+		if n.value < 0 {
+			fail(n.flag, "must not be negative, got %d", n.value)
+		}
+	}
+	if cfg.nickLimit > 0 && cfg.nickWindow <= 0 {
+		fail("nick-window", "must be positive when -nick-limit is set, got %s", cfg.nickWindow)
+	}
+	if cfg.queueConns && cfg.maxConns == 0 {
+		fail("queue-conns", "has no effect without -max-conns")
+	}
+	if cfg.acceptRate > maxAcceptRate {
+		fail("accept-rate", "must be at most %d, got %d", maxAcceptRate, cfg.acceptRate)
+	}
+
+	s.asciiOnly = cfg.asciiOnly
+	s.halfCloseGrace = cfg.halfCloseGrace
+	s.recentSize = cfg.recentSize
+	s.adaptiveMinClients = cfg.adaptiveMinClients
+	s.nickLimit = cfg.nickLimit
+	s.nickWindow = cfg.nickWindow
+	s.idleAway = cfg.idleAway
+	s.presenceWindow = cfg.presenceWindow
+	s.checkNames = cfg.checkNames
+	s.maxInvalidUTF8 = cfg.maxInvalidUTF8
+
+	// Only the template generator can fail on its pattern; blame the
+	// flag the user has to fix.
+	names, err := newNameGenerator(cfg.nameGenerator, cfg.nameTemplate)
+	switch {
+	case err == nil:
+		s.names = names
+	case cfg.nameGenerator == "template":
+		fail("name-template", "%v", err)
+	default:
+		fail("name-generator", "%v", err)
+	}
+
+	for _, name := range strings.Split(cfg.reservedNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if !validNick(name) {
+				fail("reserved-names", "%q is not a valid nickname", name)
+			}
+			s.reservedNames[nameKey(name)] = struct{}{}
+		}
+	}
+
+	if cfg.langFile != "" {
+		cat, missing, unknown, err := loadCatalog(cfg.langFile)
+		if err != nil {
+			fail("lang-file", "%v", err)
+		} else {
+			if len(missing) > 0 {
+				log.Printf("WARN: %s has no translation for %s, using English", cfg.langFile, strings.Join(missing, ", "))
+			}
+			if len(unknown) > 0 {
+				log.Printf("WARN: %s has messages with unknown IDs %s, ignoring them", cfg.langFile, strings.Join(unknown, ", "))
+			}
+			s.catalog = cat
+		}
+	}
+	if cfg.notifyBlank {
+		s.blankNotice = s.text("blank_message", nil)
+	}
+
+	if cfg.frameTrace != "" {
+		if info, err := os.Stat(filepath.Dir(cfg.frameTrace)); err != nil {
+			fail("frame-trace", "%v", err)
+		} else if !info.IsDir() {
+			fail("frame-trace", "%s is not a directory", filepath.Dir(cfg.frameTrace))
+		}
+	}
+
+	return errs
+}
+
 func main() {
-	// Initialize a new server instance
-	s := newServer()
-	go s.run()
+	var cfg config
+	flag.StringVar(&cfg.addr, "addr", ":8080", "address to listen on")
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "", "also listen on this address for admin connections (kick, announce, stats, namehistory)")
+	flag.StringVar(&cfg.adminPassword, "admin-password", os.Getenv("CHAT_ADMIN_PASSWORD"), "password admin connections must send first (default $CHAT_ADMIN_PASSWORD)")
+	flag.BoolVar(&cfg.asciiOnly, "ascii-only", false, "only accept printable 7-bit ASCII messages")
+	flag.DurationVar(&cfg.halfCloseGrace, "half-close-grace", 0, "when a client stops sending, wait up to this long for replies to its last messages to be written before closing")
+	flag.StringVar(&cfg.langFile, "lang-file", "", "JSON file of message templates overriding the built-in English texts")
+	flag.IntVar(&cfg.maxConns, "max-conns", 0, "maximum number of connections handled at once (0 for no limit)")
+	flag.IntVar(&cfg.acceptRate, "accept-rate", 0, "take on at most this many new connections per second, in bursts of up to as many (0 for no limit)")
+	flag.BoolVar(&cfg.queueConns, "queue-conns", false, "wait for a free slot instead of rejecting connections beyond -max-conns")
+	flag.IntVar(&cfg.adaptiveMinClients, "adaptive-min-clients", 0, "shrink the message size limit once more than this many clients are connected (0 disables)")
+	flag.DurationVar(&cfg.presenceWindow, "presence-window", 0, "combine join/leave notices within this window into one summary (0 disables)")
+	flag.DurationVar(&cfg.idleAway, "idle-away", 15*time.Minute, "mark clients away after this long without chatting (0 disables)")
+	flag.IntVar(&cfg.nickLimit, "nick-limit", 3, "nickname changes allowed per connection within -nick-window (0 for no limit)")
+	flag.DurationVar(&cfg.nickWindow, "nick-window", 10*time.Minute, "window for -nick-limit")
+	flag.StringVar(&cfg.nameGenerator, "name-generator", "numeric", "how guest names are picked: numeric, words or template")
+	flag.StringVar(&cfg.nameTemplate, "name-template", "guest-{number}", "pattern for -name-generator=template using {adjective}, {animal} and {number}")
+	flag.StringVar(&cfg.reservedNames, "reserved-names", "", "comma-separated names no client may use, e.g. admin,server,system")
+	flag.BoolVar(&cfg.notifyBlank, "notify-blank", false, "tell clients when their whitespace-only message was dropped")
+	flag.IntVar(&cfg.maxInvalidUTF8, "max-invalid-utf8", 5, "disconnect clients after this many invalid UTF-8 messages in a row (0 never); each one is dropped and answered with INVALID_UTF8")
+	flag.IntVar(&cfg.recentSize, "recent-size", 50, "number of recent joins and leaves kept for /recent")
+	flag.DurationVar(&cfg.warmup, "warmup", 0, "hold new connections for this long after starting before letting them join")
+	flag.BoolVar(&cfg.checkNames, "check-names", false, "DEBUG ONLY: verify the name registry after every join, rename and leave")
+	flag.StringVar(&cfg.frameTrace, "frame-trace", "", "write a pcapng trace of all connection traffic to this file")
+	validate := flag.Bool("validate", false, "check the configuration, report every problem and exit without starting the server")
+	printConfig := flag.Bool("print-config", false, "print the effective value of every setting and exit")
+	flag.Parse()
+
+	if *printConfig {
+		flag.VisitAll(func(f *flag.Flag) {
+			switch {
+			case f.Name == "print-config" || f.Name == "validate":
+			case f.Name == "admin-password" && f.Value.String() != "":
+				fmt.Printf("%s=(set)\n", f.Name)
+			default:
+				fmt.Printf("%s=%s\n", f.Name, f.Value)
+			}
+		})
+		return
+	}
 
 	// Set log flags to include file and line number
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	ln, err := net.Listen("tcp", ":8080")
+	// Initialize a new server instance
+	s := newServer()
+	errs := cfg.apply(s)
+	for _, err := range errs {
+		log.Printf("ERROR: %v", err)
+	}
+	if *validate {
+		if len(errs) > 0 {
+			log.Printf("Configuration has %d error(s)", len(errs))
+			os.Exit(1)
+		}
+		log.Printf("Configuration OK")
+		return
+	}
+	if len(errs) > 0 {
+		startupCheck("configuration is valid", fmt.Errorf("%d configuration error(s) listed above, run with -validate to recheck", len(errs)))
+	}
+	startupCheck("configuration is valid", nil)
+
+	var trace *frameTrace
+	if cfg.frameTrace != "" {
+		f, err := os.Create(cfg.frameTrace)
+		if err == nil {
+			defer f.Close()
+			trace, err = newFrameTrace(f)
+		}
+		startupCheck(fmt.Sprintf("frame trace %s is writable", cfg.frameTrace), err)
+		log.Printf("Tracing connection traffic to %s", cfg.frameTrace)
+	}
+
+	ln, err := net.Listen("tcp", cfg.addr)
 	if err != nil {
-		log.Fatalf("unable to start server: %s", err.Error())
+		err = listenError(cfg.addr, err)
 	}
+	startupCheck(fmt.Sprintf("listen address %s is free", cfg.addr), err)
+	if cfg.adminAddr != "" {
+		adminLn, err := net.Listen("tcp", cfg.adminAddr)
+		if err != nil {
+			err = listenError(cfg.adminAddr, err)
+		}
+		startupCheck(fmt.Sprintf("admin address %s is free", cfg.adminAddr), err)
+		defer adminLn.Close()
+		log.Printf("Admin port listening on %s", adminLn.Addr())
+		go s.serveAdminPort(adminLn, cfg.adminPassword)
+	}
+	go s.run()
 
-	log.Printf("Server started and listening on port 8080")
+	log.Printf("Server started and listening on %s", ln.Addr())
 	defer ln.Close()
 
+	s.warmUp(cfg.warmup)
+	s.serve(ln, &cfg, trace)
+}
+
+// warmUp closes s.ready once d has passed, letting held connections
+// join. With no warm-up it is closed before returning, so the first
+// connection is never told to wait.
+func (s *server) warmUp(d time.Duration) {
+	if d <= 0 {
+		close(s.ready)
+		return
+	}
+	log.Printf("Warming up for %s before letting clients join", d)
+	time.AfterFunc(d, func() {
+		close(s.ready)
+		log.Printf("Server ready")
+	})
+}
+
+// serve accepts chat connections on ln until it is closed, within the
+// -max-conns and -accept-rate limits of cfg, and runs a handler for each.
+func (s *server) serve(ln net.Listener, cfg *config, trace *frameTrace) {
+	// Each connection handler holds a slot in handlers until it returns.
+	var handlers chan struct{}
+	if cfg.maxConns > 0 {
+		handlers = make(chan struct{}, cfg.maxConns)
+	}
+
+	var acceptTokens <-chan struct{}
+	if cfg.acceptRate > 0 {
+		acceptTokens = newAcceptLimiter(cfg.acceptRate)
+	}
+
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("unable to accept connections: %s", err.Error())
 			// This should not be Fatal as it would terminate the server
 			continue
 		}
 
+		// Beyond -accept-rate, connections wait here and further ones in
+		// the listen backlog.
+		if acceptTokens != nil {
+			<-acceptTokens
+		}
+
+		if trace != nil {
+			conn = trace.wrap(conn)
+		}
+
 		c := s.newClient(conn)
-		s.members[conn.RemoteAddr()] = c
 
-		s.broadcast(c, fmt.Sprintf("%s joined the room", c.name))
+		// The slot is taken before the handler starts, so -max-conns
+		// bounds the number of handler goroutines.
+		if handlers != nil {
+			if cfg.queueConns {
+				handlers <- struct{}{}
+			} else {
+				select {
+				case handlers <- struct{}{}:
+				default:
+					log.Printf("Rejecting %s: already handling %d connections", conn.RemoteAddr().String(), cfg.maxConns)
+					c.msg(s.text("server_full", nil))
+					conn.Close()
+					continue
+				}
+			}
+		}
 
-		// Log the client address
-		println("Client connected:", conn.RemoteAddr().String())
+		go func() {
+			if handlers != nil {
+				defer func() { <-handlers }()
+			}
 
-		go c.readInput()
-	}
+			// Probes from other protocols are turned away before they
+			// show up in the room.
+			prefix, ok := c.sniffFirstBytes()
+			if !ok {
+				conn.Close()
+				return
+			}
+
+			// During warm-up clients are told to wait until the server is ready.
+			select {
+			case <-s.ready:
+			default:
+				c.msg(s.text("starting_up", nil))
+				<-s.ready
+			}
 
+			s.join <- c
+
+			// Log the client address
+			println("Client connected:", conn.RemoteAddr().String())
+
+			c.readInput(prefix)
+		}()
+	}
 }
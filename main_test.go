@@ -0,0 +1,1624 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The server logs every frame; keep test output readable.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConn is a net.Conn that records what the server writes to it.
+// Only the methods the server uses on members are implemented.
+type testConn struct {
+	net.Conn
+	addr net.Addr
+
+	mu     sync.Mutex
+	out    bytes.Buffer
+	closed bool
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *testConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.out.Write(p)
+}
+
+func (c *testConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// frames returns the bodies of the frames written so far.
+func (c *testConn) frames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var frames []string
+	b := c.out.Bytes()
+	for len(b) >= 4 {
+		n := binary.BigEndian.Uint32(b)
+		frames = append(frames, string(b[4:4+n]))
+		b = b[4+n:]
+	}
+	return frames
+}
+
+// newTestClient returns a client of s on a testConn with a unique
+// address. It is not a member until admitted.
+func newTestClient(s *server, port int) (*client, *testConn) {
+	conn := &testConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+	return s.newClient(conn), conn
+}
+
+func TestGuestNamesUnique(t *testing.T) {
+	s := newServer()
+	s.names = wordNames{}
+	taken := make(map[string]bool)
+	adjectives := make(map[string]bool)
+	animals := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		name := s.guestName(func(name string) bool { return taken[nameKey(name)] })
+		if taken[nameKey(name)] {
+			t.Fatalf("generation %d: %q is already taken", i, name)
+		}
+		taken[nameKey(name)] = true
+		parts := strings.Split(name, "-")
+		adjectives[parts[0]] = true
+		animals[parts[1]] = true
+	}
+	if len(adjectives) != len(nameAdjectives) || len(animals) != len(nameAnimals) {
+		t.Errorf("10000 names used %d of %d adjectives and %d of %d animals", len(adjectives), len(nameAdjectives), len(animals), len(nameAnimals))
+	}
+}
+
+func TestGuestNamesExhausted(t *testing.T) {
+	names, err := newTemplateNames("guest-{adjective}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer()
+	s.names = names
+
+	// More clients than the template has names must all still join,
+	// with distinct names.
+	seen := make(map[string]bool)
+	for i := 0; i < 2*len(nameAdjectives); i++ {
+		c, _ := newTestClient(s, 1000+i)
+		c.quietJoins = true
+		s.admit(c)
+		if seen[c.name] {
+			t.Fatalf("client %d got duplicate name %q", i, c.name)
+		}
+		seen[c.name] = true
+	}
+
+	// With every generated name reserved, a suffixed name is used.
+	for _, adjective := range nameAdjectives {
+		s.reservedNames[nameKey("guest-"+adjective)] = struct{}{}
+	}
+	name := s.guestName(nil)
+	if s.isReservedName(name) || !strings.HasSuffix(name, "-2") {
+		t.Errorf("guestName with all names reserved = %q, want an unreserved name ending in -2", name)
+	}
+}
+
+func TestNewTemplateNamesErrors(t *testing.T) {
+	for _, pattern := range []string{
+		"guest-{animal",
+		"guest",
+		"guest-{colour}",
+		"guest with space-{number}",
+		"a-very-long-guest-name-{adjective}",
+	} {
+		if _, err := newTemplateNames(pattern); err == nil {
+			t.Errorf("newTemplateNames(%q) succeeded, want an error", pattern)
+		}
+	}
+	if _, err := newTemplateNames("guest-{adjective}-{animal}"); err != nil {
+		t.Errorf("newTemplateNames of a valid pattern: %v", err)
+	}
+}
+
+// startTestServer runs a new server's run loop and returns it.
+func startTestServer() *server {
+	s := newServer()
+	go s.run()
+	return s
+}
+
+// settle waits until the run loop has handled everything sent to it
+// before the call.
+func settle(s *server) {
+	reply := make(chan string, 1)
+	s.admin <- adminRequest{line: "stats", reply: reply}
+	<-reply
+}
+
+// hasFrame reports whether conn was sent a frame equal to want.
+func hasFrame(conn *testConn, want string) bool {
+	for _, f := range conn.frames() {
+		if f == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestArchiveFollowsConnection(t *testing.T) {
+	s := startTestServer()
+	alice, _ := newTestClient(s, 1)
+	bot, botConn := newTestClient(s, 2)
+	thief, thiefConn := newTestClient(s, 3)
+	s.join <- alice
+	s.join <- bot
+	s.messages <- message{client: bot, msg: "/nick logbot"}
+	s.messages <- message{client: alice, msg: "/archive logbot"}
+	s.messages <- message{client: bot, msg: "/nick logbot2"}
+	s.messages <- message{client: alice, msg: "one"}
+	settle(s)
+	if want := "[archive] " + alice.getName() + ": one"; !hasFrame(botConn, want) {
+		t.Errorf("renamed archive target did not get %q, got %q", want, botConn.frames())
+	}
+
+	s.disconnect <- bot.conn.RemoteAddr()
+	s.join <- thief
+	s.messages <- message{client: thief, msg: "/nick logbot2"}
+	s.messages <- message{client: alice, msg: "two"}
+	settle(s)
+	for _, f := range thiefConn.frames() {
+		if strings.HasPrefix(f, "[archive]") {
+			t.Errorf("new holder of the archive target's name got a copy: %q", f)
+		}
+	}
+}
+
+func TestNameKeyMatchesEqualFold(t *testing.T) {
+	for _, pair := range [][2]string{
+		{"Bob", "bOB"},
+		{"aσ", "aς"},
+		{"aΣ", "aς"},
+		{"Kelvin", "Kelvin"},
+		{"ſam", "Sam"},
+	} {
+		if !strings.EqualFold(pair[0], pair[1]) {
+			t.Fatalf("test pair %q is not equal under EqualFold", pair)
+		}
+		if nameKey(pair[0]) != nameKey(pair[1]) {
+			t.Errorf("nameKey(%q) = %q, nameKey(%q) = %q, want the same key", pair[0], nameKey(pair[0]), pair[1], nameKey(pair[1]))
+		}
+	}
+	if nameKey("bob") == nameKey("rob") {
+		t.Error("different names share a key")
+	}
+}
+
+func TestConcurrentNickOneWins(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		s := newServer()
+		s.checkNames = true
+		go s.run()
+		a, aConn := newTestClient(s, 1)
+		b, bConn := newTestClient(s, 2)
+		s.join <- a
+		s.join <- b
+
+		var wg sync.WaitGroup
+		for _, c := range []*client{a, b} {
+			wg.Add(1)
+			go func(c *client) {
+				defer wg.Done()
+				s.messages <- message{client: c, msg: "/nick alice"}
+			}(c)
+		}
+		wg.Wait()
+		settle(s)
+
+		won := 0
+		for _, conn := range []*testConn{aConn, bConn} {
+			set := hasFrame(conn, "you are now known as alice")
+			taken := hasFrame(conn, "alice is already taken")
+			if set == taken {
+				t.Fatalf("round %d: client got set=%v taken=%v, want exactly one; frames %q", round, set, taken, conn.frames())
+			}
+			if set {
+				won++
+			}
+		}
+		if won != 1 {
+			t.Fatalf("round %d: %d clients became alice, want 1", round, won)
+		}
+		if a.getName() == b.getName() {
+			t.Fatalf("round %d: both clients are named %q", round, a.getName())
+		}
+	}
+}
+
+func TestConfigReportsEveryError(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config{
+		addr:               "8080",
+		adminAddr:          "localhost",
+		halfCloseGrace:     -time.Second,
+		presenceWindow:     -time.Second,
+		idleAway:           -time.Second,
+		warmup:             -time.Second,
+		maxConns:           -1,
+		acceptRate:         -1,
+		adaptiveMinClients: -1,
+		nickLimit:          -1,
+		recentSize:         -1,
+		maxInvalidUTF8:     -1,
+		nameGenerator:      "template",
+		nameTemplate:       "guest-{colour}",
+		reservedNames:      "ok, not valid",
+		langFile:           filepath.Join(dir, "missing.json"),
+		frameTrace:         filepath.Join(dir, "missing", "trace"),
+	}
+	errs := cfg.apply(newServer())
+
+	count := make(map[string]int)
+	for _, err := range errs {
+		flagName, _, _ := strings.Cut(err.Error(), ":")
+		count[flagName]++
+	}
+	for _, flagName := range []string{
+		"-addr", "-admin-addr", "-admin-password",
+		"-half-close-grace", "-presence-window", "-idle-away", "-warmup",
+		"-max-conns", "-accept-rate", "-adaptive-min-clients", "-nick-limit", "-recent-size", "-max-invalid-utf8",
+		"-name-template", "-reserved-names", "-lang-file", "-frame-trace",
+	} {
+		if count[flagName] != 1 {
+			t.Errorf("%d errors for %s, want 1", count[flagName], flagName)
+		}
+		delete(count, flagName)
+	}
+	for flagName, n := range count {
+		t.Errorf("%d unexpected errors for %s", n, flagName)
+	}
+	if t.Failed() {
+		t.Logf("errors: %q", errs)
+	}
+}
+
+func TestConfigDependentSettings(t *testing.T) {
+	for _, tt := range []struct {
+		cfg  config
+		flag string
+	}{
+		{config{addr: ":8080", nameGenerator: "numeric", nickLimit: 3}, "-nick-window"},
+		{config{addr: ":8080", nameGenerator: "numeric", queueConns: true}, "-queue-conns"},
+		{config{addr: ":8080", nameGenerator: "colours"}, "-name-generator"},
+	} {
+		errs := tt.cfg.apply(newServer())
+		if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), tt.flag+":") {
+			t.Errorf("apply(%+v) = %q, want one error for %s", tt.cfg, errs, tt.flag)
+		}
+	}
+	valid := config{addr: ":8080", nickLimit: 3, nickWindow: time.Minute, nameGenerator: "template", nameTemplate: "guest-{number}"}
+	if errs := valid.apply(newServer()); len(errs) != 0 {
+		t.Errorf("apply of a valid config: %q", errs)
+	}
+}
+
+func TestNameRegistryRandomOperations(t *testing.T) {
+	names := []string{"alice", "ALICE", "Alice", "bob", "Bob", "aσ", "aς", "aΣ", "ſam", "Sam"}
+	rng := rand.New(rand.NewSource(1))
+
+	s := newServer()
+	s.checkNames = true // verifyNames panics, failing the test, if the registry drifts
+	s.nickLimit = 0
+	go s.run()
+
+	var members []*client
+	port := 0
+	for step := 0; step < 2000; step++ {
+		switch op := rng.Intn(10); {
+		case op < 3 || len(members) == 0:
+			port++
+			c, _ := newTestClient(s, port)
+			c.quietJoins = true
+			s.join <- c
+			members = append(members, c)
+		case op < 8:
+			c := members[rng.Intn(len(members))]
+			s.messages <- message{client: c, msg: "/nick " + names[rng.Intn(len(names))]}
+		default:
+			i := rng.Intn(len(members))
+			s.disconnect <- members[i].conn.RemoteAddr()
+			members = append(members[:i], members[i+1:]...)
+		}
+		settle(s)
+
+		// The run loop is idle until the next send, so its state can be read.
+		if len(s.members) != len(members) || len(s.byName) != len(members) {
+			t.Fatalf("step %d: %d members and %d names, want %d", step, len(s.members), len(s.byName), len(members))
+		}
+		for i, a := range members {
+			if s.memberByName(a.name) != a {
+				t.Fatalf("step %d: %q does not look up its own member", step, a.name)
+			}
+			for _, b := range members[i+1:] {
+				if strings.EqualFold(a.name, b.name) {
+					t.Fatalf("step %d: two members are named %q and %q", step, a.name, b.name)
+				}
+			}
+		}
+	}
+}
+
+// serveTest runs s and a chat listener for it on a free local port, with
+// any warm-up over, and returns the listener's address.
+func serveTest(t *testing.T, s *server, cfg *config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	close(s.ready)
+	go s.run()
+	go s.serve(ln, cfg, nil)
+	return ln.Addr().String()
+}
+
+// dialTest connects to addr. Reads on the connection fail after 5s
+// rather than hanging the test.
+func dialTest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// readUntil reads frames from conn until one equals want, and fails t if
+// the connection ends or times out first.
+func readUntil(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	var got []string
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("waiting for %q: %v, got %q", want, err, got)
+		}
+		if frame == want {
+			return
+		}
+		got = append(got, frame)
+	}
+}
+
+// memberCount returns the number of members of s, from the admin stats.
+func memberCount(s *server) int {
+	reply := make(chan string, 1)
+	s.admin <- adminRequest{line: "stats", reply: reply}
+	var n int
+	fmt.Sscanf(<-reply, "OK members=%d", &n)
+	return n
+}
+
+// waitFor polls cond until it holds, failing t after 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestSniffRejectsOnlyOtherProtocols(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{})
+
+	probe := dialTest(t, addr)
+	io.WriteString(probe, "GET / HTTP/1.0\r\n\r\n")
+	reply, _ := io.ReadAll(probe)
+	if !strings.HasPrefix(string(reply), "HTTP/1.0 400 ") {
+		t.Errorf("HTTP probe got %q, want a 400 response", reply)
+	}
+
+	empty := dialTest(t, addr)
+	empty.Write([]byte{0, 0, 0, 0})
+	waitFor(t, "the zero-length sender to join", func() bool { return memberCount(s) == 1 })
+
+	// A client that only listens joins once sniffTimeout passes.
+	silent := dialTest(t, addr)
+	waitFor(t, "the silent client to join", func() bool { return memberCount(s) == 2 })
+
+	writeFrame(empty, "hello")
+	reply2, err := readFrame(silent)
+	for err == nil && !strings.HasSuffix(reply2, ": hello") {
+		reply2, err = readFrame(silent)
+	}
+	if err != nil {
+		t.Fatalf("silent client did not get the chat message: %v", err)
+	}
+	if n := s.wrongProtocol.Load(); n != 1 {
+		t.Errorf("%d wrong-protocol connections, want 1", n)
+	}
+}
+
+func TestReservedNamesAndImpersonation(t *testing.T) {
+	s := newServer()
+	cfg := config{addr: ":8080", nameGenerator: "numeric", reservedNames: "admin, system"}
+	if errs := cfg.apply(s); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	go s.run()
+	alice, _ := newTestClient(s, 1)
+	mallory, conn := newTestClient(s, 2)
+	s.join <- alice
+	s.join <- mallory
+	s.messages <- message{client: alice, msg: "/nick alice"}
+	settle(s)
+
+	for _, tt := range []struct{ name, want string }{
+		{"admin", "admin is a reserved name"},
+		{"SYSTEM", "SYSTEM is a reserved name"},
+		{"ſystem", "ſystem is a reserved name"},
+		{"Alice", "Alice is already taken"},
+		{"ALİCE", "ALİCE is already taken"},
+		{"mallory", "you are now known as mallory"},
+	} {
+		s.messages <- message{client: mallory, msg: "/nick " + tt.name}
+		settle(s)
+		if !hasFrame(conn, tt.want) {
+			t.Errorf("/nick %s: want %q, got %q", tt.name, tt.want, conn.frames())
+		}
+	}
+	if got := mallory.getName(); got != "mallory" {
+		t.Errorf("mallory is named %q after the only allowed rename", got)
+	}
+
+	// Generated names skip reserved ones too.
+	names, err := newTemplateNames("sys-{number}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := newServer()
+	s2.names = names
+	for i := 0; i < 1000; i++ {
+		s2.reservedNames[nameKey(fmt.Sprintf("sys-%d", i))] = struct{}{}
+	}
+	for i := 0; i < 20; i++ {
+		if name := s2.guestName(nil); s2.isReservedName(name) {
+			t.Fatalf("guestName returned reserved name %q", name)
+		}
+	}
+}
+
+func TestNameHistoryTracksRenames(t *testing.T) {
+	s := newServer()
+	s.nickLimit = 0
+	go s.run()
+	c, conn := newTestClient(s, 1)
+	other, otherConn := newTestClient(s, 2)
+	s.join <- c
+	s.join <- other
+	first := c.getName()
+
+	s.messages <- message{client: c, msg: "/namehistory"}
+	settle(s)
+	if want := first + " has not changed name"; !hasFrame(conn, want) {
+		t.Errorf("before renaming, want %q, got %q", want, conn.frames())
+	}
+
+	for _, name := range []string{"alice", "admin_alice", "bob"} {
+		s.messages <- message{client: c, msg: "/nick " + name}
+	}
+	s.messages <- message{client: c, msg: "/namehistory"}
+	s.messages <- message{client: other, msg: "/namehistory bob"}
+	settle(s)
+	if want := "bob has been known as " + first + " -> alice -> admin_alice -> bob"; !hasFrame(conn, want) {
+		t.Errorf("want %q, got %q", want, conn.frames())
+	}
+	if !hasFrame(otherConn, "usage: /namehistory, lists your own earlier names") {
+		t.Errorf("looking up another member's history: got %q", otherConn.frames())
+	}
+
+	reply := make(chan string, 1)
+	s.admin <- adminRequest{line: "namehistory BOB", reply: reply}
+	if got, want := <-reply, "OK bob has been known as "+first+" -> alice -> admin_alice -> bob"; got != want {
+		t.Errorf("admin namehistory = %q, want %q", got, want)
+	}
+}
+
+func TestHalfCloseFlushesQueuedMessages(t *testing.T) {
+	for _, grace := range []time.Duration{0, 5 * time.Second} {
+		s := newServer()
+		s.halfCloseGrace = grace
+		// Slow the run loop down so a broadcast is still being worked on
+		// when the reader sees the half-close.
+		s.events.subscribe(eventMessageReceived, func(event) { time.Sleep(100 * time.Millisecond) })
+		addr := serveTest(t, s, &config{})
+
+		reader, sender := dialTest(t, addr), dialTest(t, addr)
+		reader.Write([]byte{0, 0, 0, 0}) // A zero-length frame joins without waiting for sniffTimeout
+		sender.Write([]byte{0, 0, 0, 0})
+		waitFor(t, "both clients to join", func() bool { return memberCount(s) == 2 })
+
+		writeFrame(sender, "queued")
+		time.Sleep(20 * time.Millisecond)
+		start := time.Now()
+		if err := reader.(*net.TCPConn).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+
+		delivered := false
+		for {
+			frame, err := readFrame(reader)
+			if err != nil {
+				break
+			}
+			delivered = delivered || strings.HasSuffix(frame, ": queued")
+		}
+		if want := grace > 0; delivered != want {
+			t.Errorf("grace %s: message queued before the half-close delivered: %v, want %v", grace, delivered, want)
+		}
+		// The server closes once the message is out, not after the grace period.
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("grace %s: connection closed %s after the half-close", grace, elapsed)
+		}
+	}
+}
+
+func TestAdminPort(t *testing.T) {
+	s := newServer()
+	s.nickLimit = 0
+	addr := serveTest(t, s, &config{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serveAdminPort(ln, "secret")
+
+	member, bystander := dialTest(t, addr), dialTest(t, addr)
+	writeFrame(member, "/nick target")
+	writeFrame(bystander, "/nick bystander")
+	readUntil(t, member, "you are now known as target")
+	readUntil(t, bystander, "you are now known as bystander")
+
+	guess := dialTest(t, ln.Addr().String())
+	writeFrame(guess, "auth wrong")
+	if reply, _ := readFrame(guess); reply != "AUTH_FAILED" {
+		t.Errorf("wrong password got %q, want AUTH_FAILED", reply)
+	}
+	if _, err := readFrame(guess); err != io.EOF {
+		t.Errorf("after a failed login: %v, want the connection closed", err)
+	}
+
+	admin := dialTest(t, ln.Addr().String())
+	command := func(line, want string) {
+		t.Helper()
+		writeFrame(admin, line)
+		if reply, err := readFrame(admin); reply != want {
+			t.Errorf("%q got %q (%v), want %q", line, reply, err, want)
+		}
+	}
+	command("auth secret", "OK authenticated")
+	command("stats", "OK members=2 message_limit=4096 wrong_protocol=0")
+	command("announce maintenance at noon", "OK announced to 2 members")
+	readUntil(t, bystander, "[announcement] maintenance at noon")
+	command("kick TARGET", "OK kicked target")
+	readUntil(t, bystander, "target was removed by an admin")
+	command("kick target", "ERROR no member named target")
+	command("mute bystander", "ERROR unknown command mute, expected kick, announce, stats or namehistory")
+}
+
+func TestFrameTraceBytes(t *testing.T) {
+	var out bytes.Buffer
+	trace, err := newFrameTrace(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 123456000)
+	trace.now = func() time.Time { return at }
+
+	s := newServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	close(s.ready)
+	go s.run()
+	go s.serve(ln, &config{}, trace)
+
+	conn := dialTest(t, ln.Addr().String())
+	writeFrame(conn, "/nick tracer")
+	readUntil(t, conn, "you are now known as tracer")
+	conn.Close()
+	waitFor(t, "the disconnect", func() bool { return memberCount(s) == 0 })
+
+	// Build the expected pcapng stream by hand from the format spec.
+	be := binary.BigEndian
+	block := func(blockType uint32, body []byte) []byte {
+		total := uint32(12 + len(body))
+		b := be.AppendUint32(be.AppendUint32(nil, blockType), total)
+		return be.AppendUint32(append(b, body...), total)
+	}
+	pad := func(b []byte) []byte { return append(b, make([]byte, (4-len(b)%4)%4)...) }
+	option := func(code uint16, value []byte) []byte {
+		return pad(append(be.AppendUint16(be.AppendUint16(nil, code), uint16(len(value))), value...))
+	}
+	packet := func(direction uint32, data []byte) []byte {
+		ts := uint64(at.UnixMicro())
+		b := be.AppendUint32(nil, 0) // Interface 0
+		b = be.AppendUint32(be.AppendUint32(b, uint32(ts>>32)), uint32(ts))
+		b = be.AppendUint32(be.AppendUint32(b, uint32(len(data))), uint32(len(data)))
+		b = append(pad(append(b, data...)), option(2, be.AppendUint32(nil, direction))...)
+		return block(6, append(b, option(0, nil)...))
+	}
+	frame := func(msg string) []byte { return append(be.AppendUint32(nil, uint32(len(msg))), msg...) }
+
+	var want []byte
+	want = append(want, block(0x0A0D0D0A, []byte{0x1A, 0x2B, 0x3C, 0x4D, 0, 1, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})...)
+	idb := []byte{0, 147, 0, 0, 0, 0, 0, 0}
+	idb = append(idb, option(2, []byte(conn.LocalAddr().String()))...)
+	want = append(want, block(1, append(idb, option(0, nil)...))...)
+	want = append(want, packet(1, frame("/nick tracer")[:4])...) // Sniffed length prefix
+	want = append(want, packet(1, []byte("/nick tracer"))...)
+	want = append(want, packet(2, frame("you are now known as tracer"))...)
+
+	trace.mu.Lock()
+	got := out.Bytes()
+	trace.mu.Unlock()
+	if !bytes.Equal(got, want) {
+		t.Errorf("trace is\n%x\nwant\n%x", got, want)
+	}
+}
+
+func TestGermanCatalogFallsBackToEnglish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "de.json")
+	de := `{
+		"joined": "{{.Name}} hat den Raum betreten",
+		"nick_taken": "{{.Name}} ist schon vergeben",
+		"jonied": "Tippfehler"
+	}`
+	if err := os.WriteFile(path, []byte(de), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(io.Discard)
+	s := newServer()
+	cfg := config{addr: ":8080", nameGenerator: "numeric", langFile: path}
+	if errs := cfg.apply(s); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for _, tt := range []struct {
+		id     string
+		params map[string]any
+		want   string
+	}{
+		{"joined", map[string]any{"Name": "anna"}, "anna hat den Raum betreten"},
+		{"nick_taken", map[string]any{"Name": "bob"}, "bob ist schon vergeben"},
+		{"left", map[string]any{"Name": "anna"}, "anna left the room"},
+		{"nick_invalid", map[string]any{"Max": 3}, "nicknames are 1-3 letters, digits, '_' or '-'"},
+	} {
+		if got := s.text(tt.id, tt.params); got != tt.want {
+			t.Errorf("text(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+	_, missing, unknown, err := loadCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != len(englishMessages)-2 || slices.Contains(missing, "joined") || slices.Contains(missing, "nick_taken") {
+		t.Errorf("missing = %q, want every ID but joined and nick_taken", missing)
+	}
+	if len(unknown) != 1 || unknown[0] != "jonied" {
+		t.Errorf("unknown = %q, want [jonied]", unknown)
+	}
+	for _, want := range []string{"WARN: " + path + " has no translation for ", "WARN: " + path + " has messages with unknown IDs jonied"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log does not mention %q:\n%s", want, logged.String())
+		}
+	}
+}
+
+func TestInvalidUTF8Threshold(t *testing.T) {
+	s := newServer()
+	s.maxInvalidUTF8 = 3
+	addr := serveTest(t, s, &config{})
+	conn, other := dialTest(t, addr), dialTest(t, addr)
+	other.Write([]byte{0, 0, 0, 0})
+	waitFor(t, "the other client to join", func() bool { return memberCount(s) >= 1 })
+
+	invalid := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			writeFrame(conn, "bad \xff\xfe")
+			readUntil(t, conn, "INVALID_UTF8")
+		}
+	}
+	version := func() {
+		t.Helper()
+		writeFrame(conn, "/version")
+		for {
+			frame, err := readFrame(conn)
+			if err != nil {
+				t.Fatalf("waiting for the /version reply: %v", err)
+			}
+			if strings.HasPrefix(frame, "Protocol: ") {
+				return
+			}
+		}
+	}
+
+	// A valid message in between resets the count.
+	invalid(2)
+	version()
+	invalid(2)
+	version()
+
+	// The third in a row disconnects without a reply.
+	invalid(2)
+	writeFrame(conn, "bad \xff\xfe")
+	if frame, err := readFrame(conn); err != io.EOF {
+		t.Errorf("after 3 invalid messages in a row got %q, %v, want the connection closed", frame, err)
+	}
+
+	// None of them reached the other member.
+	writeFrame(other, "/version")
+	for {
+		frame, err := readFrame(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(frame, "bad ") {
+			t.Errorf("invalid message was broadcast: %q", frame)
+		}
+		if strings.HasPrefix(frame, "Protocol: ") {
+			break
+		}
+	}
+}
+
+func TestClosingClientSkippedMidBroadcast(t *testing.T) {
+	s := startTestServer()
+	alice, _ := newTestClient(s, 1)
+	bot, botConn := newTestClient(s, 2)
+	s.join <- alice
+	s.join <- bot
+	s.messages <- message{client: bot, msg: "/nick logbot"}
+	s.messages <- message{client: alice, msg: "/archive logbot"}
+	settle(s)
+	before := len(botConn.frames())
+
+	// What readInput does on the way out, before the run loop hears of
+	// the disconnect.
+	bot.closed.Store(true)
+	botConn.Close()
+	s.messages <- message{client: alice, msg: "during teardown"}
+	settle(s)
+	if n := bot.dropped.Load(); n != 0 || len(botConn.frames()) != before {
+		t.Errorf("closing client was written to: %d failed writes", n)
+	}
+	s.disconnect <- bot.conn.RemoteAddr()
+	if n := memberCount(s); n != 1 {
+		t.Errorf("%d members after the disconnect, want 1", n)
+	}
+}
+
+func TestClientClosesDuringBroadcasts(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{})
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		conn := dialTest(t, addr)
+		conn.Write([]byte{0, 0, 0, 0})
+		conns = append(conns, conn)
+	}
+	waitFor(t, "10 members", func() bool { return memberCount(s) == 10 })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			writeFrame(conns[0], fmt.Sprintf("message %d", i))
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	for _, conn := range conns[5:] {
+		conn.Close()
+	}
+	<-done
+	waitFor(t, "the closed clients to be removed", func() bool { return memberCount(s) == 5 })
+
+	// The rest still get chat.
+	writeFrame(conns[0], "after")
+	for _, conn := range conns[1:5] {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			frame, err := readFrame(conn)
+			if err != nil {
+				t.Fatalf("remaining member: %v", err)
+			}
+			if strings.HasSuffix(frame, ": after") {
+				break
+			}
+		}
+	}
+}
+
+func TestLinearMessageLimit(t *testing.T) {
+	for _, tt := range []struct {
+		clients int
+		want    uint32
+	}{
+		{0, 4096}, {10, 4096}, {55, 2560}, {100, 1024}, {1000, 1024},
+	} {
+		if got := linearMessageLimit(4096, 10, tt.clients); got != tt.want {
+			t.Errorf("linearMessageLimit(4096, 10, %d) = %d, want %d", tt.clients, got, tt.want)
+		}
+	}
+}
+
+func TestAdaptiveMessageLimit(t *testing.T) {
+	s := newServer()
+	s.adaptiveMinClients = 10
+	addr := serveTest(t, s, &config{})
+	stats := func() string {
+		reply := make(chan string, 1)
+		s.admin <- adminRequest{line: "stats", reply: reply}
+		return <-reply
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 100; i++ {
+		conn := dialTest(t, addr)
+		conn.Write([]byte{0, 0, 0, 0})
+		conns = append(conns, conn)
+	}
+	waitFor(t, "100 members", func() bool { return memberCount(s) == 100 })
+	if got, want := stats(), "OK members=100 message_limit=1024 wrong_protocol=0"; got != want {
+		t.Errorf("stats = %q, want %q", got, want)
+	}
+
+	// Too large for the reduced limit, but not for the protocol: the
+	// message is skipped and the client stays connected.
+	writeFrame(conns[0], strings.Repeat("x", 2000))
+	readUntil(t, conns[0], "MESSAGE_TOO_LARGE: current_limit=1024")
+	writeFrame(conns[0], "/nick stillhere")
+	readUntil(t, conns[0], "you are now known as stillhere")
+
+	for _, conn := range conns[10:] {
+		conn.Close()
+	}
+	waitFor(t, "the limit to recover", func() bool { return stats() == "OK members=10 message_limit=4096 wrong_protocol=0" })
+}
+
+func TestASCIIOnlyRejectsUnicode(t *testing.T) {
+	s := newServer()
+	s.asciiOnly = true
+	go s.run()
+	sender, senderConn := newTestClient(s, 1)
+	other, otherConn := newTestClient(s, 2)
+	s.join <- sender
+	s.join <- other
+
+	for _, msg := range []string{"café", "naïve", "snow ☃", "bell \a"} {
+		s.messages <- message{client: sender, msg: msg}
+	}
+	s.messages <- message{client: sender, msg: "plain\ttext"}
+	settle(s)
+
+	replies := 0
+	for _, f := range senderConn.frames() {
+		if f == "INVALID_CHARSET" {
+			replies++
+		}
+	}
+	if replies != 4 {
+		t.Errorf("sender got %d INVALID_CHARSET replies, want 4: %q", replies, senderConn.frames())
+	}
+	frames := otherConn.frames()
+	if want := sender.getName() + ": plain\ttext"; len(frames) == 0 || frames[len(frames)-1] != want {
+		t.Errorf("other member got %q, want only %q after the join", frames, want)
+	}
+	for _, f := range frames {
+		if strings.Contains(f, "café") || strings.Contains(f, "naïve") || strings.Contains(f, "snow") || strings.Contains(f, "bell") {
+			t.Errorf("rejected message was broadcast: %q", f)
+		}
+	}
+}
+
+func TestMaxConnsRejects(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{maxConns: 2})
+	first, second := dialTest(t, addr), dialTest(t, addr)
+	first.Write([]byte{0, 0, 0, 0})
+	second.Write([]byte{0, 0, 0, 0})
+	waitFor(t, "2 members", func() bool { return memberCount(s) == 2 })
+
+	third := dialTest(t, addr)
+	readUntil(t, third, "server is full, try again later")
+	if _, err := readFrame(third); err != io.EOF {
+		t.Errorf("rejected connection: %v, want it closed", err)
+	}
+
+	// A freed slot is available to the next connection.
+	first.Close()
+	waitFor(t, "the first client to leave", func() bool { return memberCount(s) == 1 })
+	fourth := dialTest(t, addr)
+	fourth.Write([]byte{0, 0, 0, 0})
+	waitFor(t, "the fourth client to join", func() bool { return memberCount(s) == 2 })
+}
+
+func TestMaxConnsBoundsHandlers(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{maxConns: 2, queueConns: true})
+	held := []net.Conn{dialTest(t, addr), dialTest(t, addr)}
+	for i, conn := range held {
+		writeFrame(conn, fmt.Sprintf("/nick held%d", i))
+		readUntil(t, conn, fmt.Sprintf("you are now known as held%d", i))
+	}
+
+	// Connections beyond the cap wait in the accept loop and the listen
+	// backlog, without a goroutine each.
+	before := runtime.NumGoroutine()
+	var queued []net.Conn
+	for i := 0; i < 50; i++ {
+		conn := dialTest(t, addr)
+		conn.Write([]byte{0, 0, 0, 0})
+		queued = append(queued, conn)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine() - before; n > 5 {
+		t.Errorf("%d more goroutines with 50 connections queued beyond -max-conns", n)
+	}
+	if n := memberCount(s); n != 2 {
+		t.Errorf("%d members with -max-conns 2", n)
+	}
+
+	// Each handler that finishes lets one queued connection in.
+	held[0].Close()
+	waitFor(t, "a queued client to replace held0", func() bool {
+		reply := make(chan string, 1)
+		s.admin <- adminRequest{line: "namehistory held0", reply: reply}
+		return strings.HasPrefix(<-reply, "ERROR") && memberCount(s) == 2
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := memberCount(s); n != 2 {
+		t.Errorf("%d members after one left, want 2", n)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	if errs := (&config{addr: ":8080", nameGenerator: "numeric", acceptRate: 2e9}).apply(newServer()); len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "-accept-rate:") {
+		t.Errorf("-accept-rate 2e9: got %q, want one -accept-rate error", errs)
+	}
+
+	const rate = 20
+	s := newServer()
+	addr := serveTest(t, s, &config{acceptRate: rate})
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		conn := dialTest(t, addr)
+		conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	// A burst of rate connections is let in at once, then rate a second.
+	time.Sleep(time.Second)
+	n := memberCount(s)
+	if allowed := rate + int(time.Since(start).Seconds()*rate) + 1; n > allowed {
+		t.Errorf("%d members after %s, want at most %d", n, time.Since(start), allowed)
+	}
+	if n < rate {
+		t.Errorf("%d members after %s, want at least the burst of %d", n, time.Since(start), rate)
+	}
+	waitFor(t, "more connections to be taken on", func() bool { return memberCount(s) >= n+rate/2 })
+}
+
+func TestIdleAway(t *testing.T) {
+	// The run loop is not started; markIdle is called directly, as its
+	// ticker would.
+	s := newServer()
+	s.idleAway = 15 * time.Minute
+	var conns []*testConn
+	var members []*client
+	for i, name := range []string{"anna", "bob", "carl"} {
+		c, conn := newTestClient(s, i+1)
+		s.admit(c)
+		s.msg(c, "/nick "+name)
+		members, conns = append(members, c), append(conns, conn)
+	}
+	anna, bob, carl := members[0], members[1], members[2]
+	idleNotices := func(conn *testConn) int {
+		n := 0
+		for _, f := range conn.frames() {
+			if strings.HasSuffix(f, "now away (idle)") {
+				n++
+			}
+		}
+		return n
+	}
+
+	anna.lastActivity = time.Now().Add(-16 * time.Minute)
+	bob.lastActivity = time.Now().Add(-20 * time.Minute)
+	s.markIdle()
+	s.markIdle()
+	if !anna.away || !bob.away || carl.away {
+		t.Fatalf("away flags anna=%v bob=%v carl=%v, want true true false", anna.away, bob.away, carl.away)
+	}
+	if !hasFrame(conns[2], "anna, bob are now away (idle)") || idleNotices(conns[2]) != 1 {
+		t.Errorf("want one combined idle notice, got %q", conns[2].frames())
+	}
+
+	s.msg(carl, "/who")
+	if want := "3 online: anna (away), bob (away), carl (page 1/1)"; !hasFrame(conns[2], want) {
+		t.Errorf("/who: want %q, got %q", want, conns[2].frames())
+	}
+
+	// Commands are not activity; chat is.
+	s.msg(bob, "/who")
+	s.msg(anna, "hello")
+	if anna.away || !bob.away {
+		t.Errorf("after anna chatted and bob ran a command: anna away=%v bob away=%v", anna.away, bob.away)
+	}
+	if !hasFrame(conns[2], "anna is back") {
+		t.Errorf("no return notice, got %q", conns[2].frames())
+	}
+	s.msg(carl, "/who")
+	if want := "3 online: anna, bob (away), carl (page 1/1)"; !hasFrame(conns[2], want) {
+		t.Errorf("/who: want %q, got %q", want, conns[2].frames())
+	}
+}
+
+func TestListenErrorOccupiedPort(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	addr := held.Addr().String()
+
+	_, err = net.Listen("tcp", addr)
+	if err == nil {
+		t.Fatal("second listener on the same address succeeded")
+	}
+	msg := listenError(addr, err).Error()
+	if want := "address " + addr + " is already in use"; !strings.Contains(msg, want) || !strings.Contains(msg, "is another instance running?") {
+		t.Errorf("listenError = %q, want it to contain %q and ask about another instance", msg, want)
+	}
+	if runtime.GOOS == "linux" {
+		if want := fmt.Sprintf("by pid %d", os.Getpid()); !strings.Contains(msg, want) {
+			t.Errorf("listenError = %q, want the holder named: %q", msg, want)
+		}
+	}
+}
+
+func TestFrameTraceDirDiagnostics(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{addr: ":8080", nameGenerator: "numeric", frameTrace: filepath.Join(file, "trace.pcapng")}
+	errs := cfg.apply(newServer())
+	if want := "-frame-trace: " + file + " is not a directory"; len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("apply = %q, want [%q]", errs, want)
+	}
+}
+
+func TestWarmupHoldsConnections(t *testing.T) {
+	s := newServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.run()
+	const warmup = 500 * time.Millisecond
+	start := time.Now()
+	s.warmUp(warmup)
+	go s.serve(ln, &config{}, nil)
+
+	early := dialTest(t, ln.Addr().String())
+	writeFrame(early, "/nick early")
+	readUntil(t, early, "server is starting up, you will join shortly")
+	if n := memberCount(s); n != 0 {
+		t.Errorf("%d members during warm-up, want 0", n)
+	}
+
+	// Once ready, the held connection joins and its first message is handled.
+	readUntil(t, early, "you are now known as early")
+	if elapsed := time.Since(start); elapsed < warmup {
+		t.Errorf("joined %s after starting, before the %s warm-up ended", elapsed, warmup)
+	}
+
+	late := dialTest(t, ln.Addr().String())
+	writeFrame(late, "/nick late")
+	if frame, err := readFrame(late); frame != "you are now known as late" {
+		t.Errorf("after warm-up the first reply is %q (%v), want the /nick reply", frame, err)
+	}
+}
+
+func TestExceptMsgSkipsListedMembers(t *testing.T) {
+	s := newServer()
+	go s.run()
+	var members []*client
+	var conns []*testConn
+	for i, name := range []string{"alice", "bob", "carol", "dave"} {
+		c, conn := newTestClient(s, i+1)
+		s.join <- c
+		s.messages <- message{client: c, msg: "/nick " + name}
+		members = append(members, c)
+		conns = append(conns, conn)
+	}
+	alice := members[0]
+	s.messages <- message{client: alice, msg: "/exceptmsg BOB,carol  surprise party  "}
+	settle(s)
+
+	const want = "alice: surprise party"
+	for i, received := range []bool{false, false, false, true} {
+		if got := hasFrame(conns[i], want); got != received {
+			t.Errorf("member %d received %q: %v, want %v; frames %q", i, want, got, received, conns[i].frames())
+		}
+	}
+
+	for _, tt := range []struct{ line, want string }{
+		{"/exceptmsg bob", "usage: /exceptmsg <name,name,...> <message>"},
+		{"/exceptmsg bob,nobody hi", "no user named nobody"},
+	} {
+		s.messages <- message{client: alice, msg: tt.line}
+		settle(s)
+		if !hasFrame(conns[0], tt.want) {
+			t.Errorf("%s: want %q, got %q", tt.line, tt.want, conns[0].frames())
+		}
+	}
+	if hasFrame(conns[3], "alice: hi") {
+		t.Error("/exceptmsg with an unknown name was still sent")
+	}
+}
+
+func TestWhoPages(t *testing.T) {
+	s := newServer()
+	go s.run()
+	const members = 400
+	var want []string
+	var asker *testConn
+	for i := 0; i < members; i++ {
+		c, conn := newTestClient(s, i+1)
+		name := fmt.Sprintf("member-%03d-xxxxxxxxx", i)
+		s.join <- c
+		s.messages <- message{client: c, msg: "/nick " + name}
+		want = append(want, name)
+		asker = conn
+	}
+	settle(s)
+	if n := memberCount(s); n != members {
+		t.Fatalf("%d members, want %d", n, members)
+	}
+	me := s.memberByName(want[members-1])
+
+	var got []string
+	pages := 0
+	for page := 1; pages == 0 || page <= pages; page++ {
+		s.messages <- message{client: me, msg: fmt.Sprintf("/who %d", page)}
+		settle(s)
+		frames := asker.frames()
+		reply := frames[len(frames)-1]
+		if len(reply) > int(maxMessageSize) {
+			t.Errorf("page %d is %d bytes, over the %d byte frame limit", page, len(reply), maxMessageSize)
+		}
+		var n, total int
+		prefix := fmt.Sprintf("%d online: ", members)
+		open := strings.LastIndex(reply, " (page ")
+		if !strings.HasPrefix(reply, prefix) || open < 0 {
+			t.Fatalf("page %d: unexpected reply %q", page, reply)
+		}
+		fmt.Sscanf(reply[open:], " (page %d/%d)", &n, &total)
+		if n != page || (pages != 0 && total != pages) {
+			t.Fatalf("page %d is labelled %d/%d", page, n, total)
+		}
+		pages = total
+		got = append(got, strings.Split(reply[len(prefix):open], ", ")...)
+	}
+	if pages < 2 {
+		t.Errorf("%d members fit on %d page, want several", members, pages)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("pages list %d names, want each of the %d members once in order", len(got), members)
+	}
+
+	s.messages <- message{client: me, msg: fmt.Sprintf("/who %d", pages+1)}
+	settle(s)
+	if usage := fmt.Sprintf("usage: /who [page], pages 1-%d", pages); !hasFrame(asker, usage) {
+		t.Errorf("/who past the last page: want %q", usage)
+	}
+}
+
+func TestProtocolReflectsConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		setup func(s *server)
+		want  map[string]string
+	}{
+		{"defaults", func(s *server) {}, map[string]string{
+			"charset":          "utf-8",
+			"max_invalid_utf8": "0",
+			"half_close_grace": "0s",
+		}},
+		{"configured", func(s *server) {
+			s.asciiOnly = true
+			s.maxInvalidUTF8 = 3
+			s.halfCloseGrace = 1500 * time.Millisecond
+		}, map[string]string{
+			"charset":          "ascii",
+			"max_invalid_utf8": "3",
+			"half_close_grace": "1.5s",
+		}},
+	} {
+		s := newServer()
+		tt.setup(s)
+		go s.run()
+		c, conn := newTestClient(s, 1)
+		s.join <- c
+		s.messages <- message{client: c, msg: "/protocol"}
+		settle(s)
+
+		var reply string
+		for _, f := range conn.frames() {
+			if strings.HasPrefix(f, "PROTOCOL ") {
+				reply = f
+			}
+		}
+		fields := strings.Fields(reply)
+		if len(fields) == 0 {
+			t.Fatalf("%s: no PROTOCOL reply in %q", tt.name, conn.frames())
+		}
+		got := make(map[string]string)
+		for _, kv := range fields[1:] {
+			k, v, _ := strings.Cut(kv, "=")
+			got[k] = v
+		}
+		tt.want["max_size"] = fmt.Sprint(maxMessageSize)
+		tt.want["current_limit"] = fmt.Sprint(c.messageLimit.Load())
+		tt.want["length_prefix"] = "4"
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: %s=%q, want %q in %q", tt.name, k, got[k], v, reply)
+			}
+		}
+	}
+}
+
+func TestPresenceWindowSummarizesChurn(t *testing.T) {
+	s := newServer()
+	s.presenceWindow = 200 * time.Millisecond
+	go s.run()
+	observer, conn := newTestClient(s, 1)
+	s.join <- observer
+	// Let the observer's own join notice go out before the churn starts.
+	time.Sleep(2 * s.presenceWindow)
+
+	var churn []*client
+	for i := 0; i < 5; i++ {
+		c, _ := newTestClient(s, 100+i)
+		s.join <- c
+		churn = append(churn, c)
+	}
+	for _, c := range churn[:3] {
+		s.disconnect <- c.conn.RemoteAddr()
+	}
+	const want = "5 users joined, 3 left"
+	waitFor(t, "the presence summary", func() bool { return hasFrame(conn, want) })
+	time.Sleep(2 * s.presenceWindow)
+
+	summaries := 0
+	for _, f := range conn.frames() {
+		if strings.HasSuffix(f, " joined the room") || strings.HasSuffix(f, " left the room") {
+			t.Errorf("observer got an individual notice %q during the window", f)
+		}
+		if f == want {
+			summaries++
+		}
+	}
+	if summaries != 1 {
+		t.Errorf("observer got %d summaries, want 1: %q", summaries, conn.frames())
+	}
+
+	// A lone event in a later window keeps its own notice.
+	last := churn[4]
+	s.disconnect <- last.conn.RemoteAddr()
+	waitFor(t, "the lone leave notice", func() bool { return hasFrame(conn, last.getName()+" left the room") })
+}
+
+func TestWhitespaceOnlyNotBroadcast(t *testing.T) {
+	s := newServer()
+	s.blankNotice = s.text("blank_message", nil)
+	addr := serveTest(t, s, &config{})
+	sender := dialTest(t, addr)
+	writeFrame(sender, "/nick sender")
+	readUntil(t, sender, "you are now known as sender")
+	other := dialTest(t, addr)
+	writeFrame(other, "/nick other")
+	readUntil(t, other, "you are now known as other")
+
+	for _, msg := range []string{" ", "     ", " \t \r\n "} {
+		writeFrame(sender, msg)
+		readUntil(t, sender, "empty message not sent")
+	}
+	writeFrame(sender, "  after  ")
+
+	for {
+		frame, err := readFrame(other)
+		if err != nil {
+			t.Fatalf("other did not get the message after the blank ones: %v", err)
+		}
+		if frame == "sender: after" {
+			break
+		}
+		if strings.HasPrefix(frame, "sender:") {
+			t.Errorf("whitespace-only message was broadcast as %q", frame)
+		}
+	}
+}
+
+func TestQuietJoinsHidesPresenceOnly(t *testing.T) {
+	s := newServer()
+	go s.run()
+	quiet, quietConn := newTestClient(s, 1)
+	loud, loudConn := newTestClient(s, 2)
+	s.join <- quiet
+	s.join <- loud
+	s.messages <- message{client: quiet, msg: "/quietjoins"}
+	settle(s)
+	if !hasFrame(quietConn, "join and leave notices are now hidden") {
+		t.Fatalf("/quietjoins not confirmed: %q", quietConn.frames())
+	}
+
+	guest, _ := newTestClient(s, 3)
+	s.join <- guest
+	s.messages <- message{client: guest, msg: "hello"}
+	s.disconnect <- guest.conn.RemoteAddr()
+	settle(s)
+	name := guest.getName()
+	for _, tt := range []struct {
+		conn *testConn
+		want bool
+	}{{quietConn, false}, {loudConn, true}} {
+		for _, notice := range []string{name + " joined the room", name + " left the room"} {
+			if got := hasFrame(tt.conn, notice); got != tt.want {
+				t.Errorf("got %q: %v, want %v", notice, got, tt.want)
+			}
+		}
+		if !hasFrame(tt.conn, name+": hello") {
+			t.Errorf("chat from %s not delivered: %q", name, tt.conn.frames())
+		}
+	}
+
+	// Toggling again shows notices once more.
+	s.messages <- message{client: quiet, msg: "/quietjoins"}
+	late, _ := newTestClient(s, 4)
+	s.join <- late
+	settle(s)
+	if !hasFrame(quietConn, "join and leave notices are now shown") || !hasFrame(quietConn, late.getName()+" joined the room") {
+		t.Errorf("notices still hidden after turning /quietjoins off: %q", quietConn.frames())
+	}
+}
+
+func TestQuitSaysGoodbye(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{})
+	watcher := dialTest(t, addr)
+	writeFrame(watcher, "/nick watcher")
+	readUntil(t, watcher, "you are now known as watcher")
+
+	quitter := dialTest(t, addr)
+	writeFrame(quitter, "/nick quitter")
+	readUntil(t, quitter, "you are now known as quitter")
+	writeFrame(quitter, "/quit")
+	readUntil(t, watcher, "quitter left (said goodbye)")
+	if _, err := io.ReadAll(quitter); err != nil {
+		t.Errorf("/quit did not close the connection cleanly: %v", err)
+	}
+
+	// Dropping the connection without /quit is an ordinary leave.
+	dropper := dialTest(t, addr)
+	writeFrame(dropper, "/nick dropper")
+	readUntil(t, dropper, "you are now known as dropper")
+	dropper.Close()
+	readUntil(t, watcher, "dropper left the room")
+}
+
+func TestRecentKeepsLatestPresence(t *testing.T) {
+	s := newServer()
+	s.recentSize = 4
+	go s.run()
+	asker, conn := newTestClient(s, 1)
+	s.join <- asker
+	var guests []*client
+	for i := 0; i < 3; i++ {
+		g, _ := newTestClient(s, 10+i)
+		s.join <- g
+		guests = append(guests, g)
+	}
+	s.disconnect <- guests[0].conn.RemoteAddr()
+	s.disconnect <- guests[1].conn.RemoteAddr()
+	settle(s)
+
+	recent := func(line string) []string {
+		t.Helper()
+		before := len(conn.frames())
+		s.messages <- message{client: asker, msg: line}
+		settle(s)
+		var events []string
+		for _, f := range conn.frames()[before:] {
+			// Drop the "15:04:05 " timestamp.
+			if len(f) < 9 || f[2] != ':' || f[5] != ':' {
+				t.Fatalf("%s: reply %q has no timestamp", line, f)
+			}
+			events = append(events, f[9:])
+		}
+		return events
+	}
+
+	g := func(i int) string { return guests[i].getName() }
+	want := []string{g(1) + " joined", g(2) + " joined", g(0) + " left", g(1) + " left"}
+	if got := recent("/recent"); !slices.Equal(got, want) {
+		t.Errorf("/recent = %q, want the last %d events %q", got, s.recentSize, want)
+	}
+	if got := recent("/recent 2"); !slices.Equal(got, want[2:]) {
+		t.Errorf("/recent 2 = %q, want %q", got, want[2:])
+	}
+
+	before := len(conn.frames())
+	s.messages <- message{client: asker, msg: "/recent 0"}
+	settle(s)
+	if got := conn.frames()[before:]; !slices.Equal(got, []string{"usage: /recent [count]"}) {
+		t.Errorf("/recent 0 = %q, want the usage", got)
+	}
+
+	empty := newServer()
+	empty.recentSize = 0
+	go empty.run()
+	c, emptyConn := newTestClient(empty, 1)
+	empty.join <- c
+	empty.messages <- message{client: c, msg: "/recent"}
+	settle(empty)
+	if !hasFrame(emptyConn, "no recent joins or leaves") {
+		t.Errorf("/recent with -recent-size 0 = %q", emptyConn.frames())
+	}
+}
+
+func TestLeaveMessageOnDisconnect(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{})
+	watcher := dialTest(t, addr)
+	writeFrame(watcher, "/nick watcher")
+	readUntil(t, watcher, "you are now known as watcher")
+
+	leaver := dialTest(t, addr)
+	writeFrame(leaver, "/nick leaver")
+	readUntil(t, leaver, "you are now known as leaver")
+	writeFrame(leaver, "/leavemsg  off to \x07lunch ")
+	readUntil(t, leaver, "leave message set to: off to lunch")
+	leaver.Close()
+	readUntil(t, watcher, "leaver left: off to lunch")
+
+	// Once cleared, the message no longer replaces the usual notice.
+	quitter := dialTest(t, addr)
+	writeFrame(quitter, "/nick quitter")
+	readUntil(t, quitter, "you are now known as quitter")
+	writeFrame(quitter, "/leavemsg bye all")
+	readUntil(t, quitter, "leave message set to: bye all")
+	writeFrame(quitter, "/leavemsg")
+	readUntil(t, quitter, "leave message cleared")
+	writeFrame(quitter, "/quit")
+	readUntil(t, watcher, "quitter left (said goodbye)")
+
+	long := strings.Repeat("x", maxLeaveMsgLen+20)
+	if got := sanitizeLeaveMsg(long); len(got) != maxLeaveMsgLen {
+		t.Errorf("leave message kept %d runes, want at most %d", len(got), maxLeaveMsgLen)
+	}
+}
+
+func TestTimeZonePerClient(t *testing.T) {
+	s := newServer()
+	go s.run()
+	tokyo, tokyoConn := newTestClient(s, 1)
+	utc, utcConn := newTestClient(s, 2)
+	s.join <- tokyo
+	s.join <- utc
+	s.messages <- message{client: tokyo, msg: "/tz Asia/Tokyo"}
+	s.messages <- message{client: utc, msg: "/tz UTC"}
+	s.messages <- message{client: utc, msg: "/tz Mars/Olympus_Mons"}
+	s.messages <- message{client: utc, msg: "/tz"}
+	settle(s)
+	if !hasFrame(tokyoConn, "timestamps will be shown in Asia/Tokyo") {
+		t.Fatalf("/tz Asia/Tokyo not accepted: %q", tokyoConn.frames())
+	}
+	for _, want := range []string{
+		"unknown time zone Mars/Olympus_Mons",
+		"timestamps are shown in UTC, use /tz <zone> to change",
+	} {
+		if !hasFrame(utcConn, want) {
+			t.Errorf("want %q, got %q", want, utcConn.frames())
+		}
+	}
+
+	// Both see the same join event, each in their own zone.
+	clock := func(c *client, conn *testConn) time.Duration {
+		t.Helper()
+		s.messages <- message{client: c, msg: "/recent 1"}
+		settle(s)
+		frames := conn.frames()
+		at, err := time.Parse("15:04:05", strings.Fields(frames[len(frames)-1])[0])
+		if err != nil {
+			t.Fatalf("/recent reply %q has no time: %v", frames[len(frames)-1], err)
+		}
+		return at.Sub(at.Truncate(24 * time.Hour))
+	}
+	diff := (clock(tokyo, tokyoConn) - clock(utc, utcConn) + 24*time.Hour) % (24 * time.Hour)
+	if diff != 9*time.Hour {
+		t.Errorf("Tokyo time is %s ahead of UTC, want 9h", diff)
+	}
+}
+
+func TestConnInfoCounts(t *testing.T) {
+	s := newServer()
+	addr := serveTest(t, s, &config{})
+	conn := dialTest(t, addr)
+	sent := []string{"/nick counter", "hello", "   ", "/conninfo"}
+	bytesIn := 0
+	for _, msg := range sent {
+		writeFrame(conn, msg)
+		bytesIn += 4 + len(msg)
+	}
+
+	// Everything written to the client before the reply is counted in it.
+	framesOut, bytesOut := 0, 0
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("no /conninfo reply: %v", err)
+		}
+		if strings.HasPrefix(frame, "connected ") {
+			want := fmt.Sprintf("connected 0s | you sent %d messages (%d bytes) | you received %d messages (%d bytes) | 0 not delivered",
+				len(sent), bytesIn, framesOut, bytesOut)
+			if frame != want {
+				t.Errorf("/conninfo = %q, want %q", frame, want)
+			}
+			break
+		}
+		framesOut++
+		bytesOut += 4 + len(frame)
+	}
+	if framesOut == 0 {
+		t.Error("no frames were sent before the /conninfo reply")
+	}
+}